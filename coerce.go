@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// typeMismatch is returned when a value in the event can not be coerced into
+// the type of a rule, the rule is not met
+type typeMismatch struct {
+	expected string
+	value    interface{}
+}
+
+func (tm typeMismatch) Error() string {
+	return fmt.Sprintf("expected %s, got %s %s", tm.expected, jsonType(tm.value), describeValue(tm.value))
+}
+
+// jsonType names the JSON type of a decoded value
+func jsonType(val interface{}) string {
+	switch val.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return fmt.Sprintf("%T", val)
+}
+
+// describeValue shortens values for logs, objects and arrays are only
+// described by their size
+func describeValue(val interface{}) string {
+	switch v := val.(type) {
+	case string:
+		if len(v) > 40 {
+			v = v[:40] + "..."
+		}
+		return strconv.Quote(v)
+	case []interface{}:
+		return fmt.Sprintf("of %d items", len(v))
+	case map[string]interface{}:
+		return fmt.Sprintf("with %d keys", len(v))
+	}
+	return fmt.Sprint(val)
+}
+
+// coerceBool accepts booleans and the strings "true" and "false"
+func coerceBool(val interface{}) (bool, error) {
+	switch v := val.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		}
+	}
+	return false, typeMismatch{"a boolean", val}
+}
+
+// coerceNumber accepts numbers, numeric strings and timestamps, which are
+// compared as seconds since the Unix epoch
+func coerceNumber(val interface{}) (float64, error) {
+	switch v := val.(type) {
+	case float64:
+		return v, nil
+	case string:
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err == nil {
+			return f, nil
+		}
+		t, ok := parseTimestamp(v)
+		if ok {
+			return float64(t.UnixNano()) / float64(time.Second), nil
+		}
+	}
+	return 0, typeMismatch{"a number", val}
+}
+
+// coerceString accepts strings, and numbers and booleans as they are written
+// in JSON
+func coerceString(val interface{}) (string, error) {
+	switch v := val.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", typeMismatch{"a string", val}
+}
+
+func coerceArray(val interface{}) ([]interface{}, error) {
+	items, ok := val.([]interface{})
+	if !ok {
+		return nil, typeMismatch{"an array", val}
+	}
+	return items, nil
+}
+
+// coerceTime accepts ISO 8601 timestamps and numbers of seconds since the
+// Unix epoch
+func coerceTime(val interface{}) (time.Time, error) {
+	switch v := val.(type) {
+	case time.Time:
+		return v, nil
+	case float64:
+		t, ok := unixSeconds(v)
+		if ok {
+			return t, nil
+		}
+	case string:
+		t, ok := parseTimestamp(v)
+		if ok {
+			return t, nil
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err == nil {
+			t, ok := unixSeconds(f)
+			if ok {
+				return t, nil
+			}
+		}
+	}
+	return time.Time{}, typeMismatch{"a timestamp", val}
+}
+
+// maxUnixSeconds is the most seconds from the epoch we accept, the range of
+// time.Duration, up to the year 2262. Milliseconds since the epoch are far
+// beyond it.
+const maxUnixSeconds = float64(math.MaxInt64 / int64(time.Second))
+
+// unixSeconds converts seconds since the epoch to a time, it returns false
+// when they would overflow
+func unixSeconds(f float64) (time.Time, bool) {
+	if math.IsNaN(f) || f > maxUnixSeconds || f < -maxUnixSeconds {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(f*float64(time.Second))), true
+}
+
+// timestampLayouts are the ISO 8601 layouts we recognize
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func parseTimestamp(s string) (time.Time, bool) {
+	s = strings.TrimSpace(s)
+	for _, layout := range timestampLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoerceNumber(t *testing.T) {
+	f, err := coerceNumber(float64(12))
+	assert.Nil(t, err)
+	assert.Equal(t, float64(12), f)
+
+	f, err = coerceNumber(" 120.5 ")
+	assert.Nil(t, err)
+	assert.Equal(t, 120.5, f)
+
+	f, err = coerceNumber("2024-01-08T12:00:00Z")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1704715200), f)
+
+	for _, val := range []interface{}{"abc", true, []interface{}{}, map[string]interface{}{}} {
+		_, err := coerceNumber(val)
+		assert.IsType(t, typeMismatch{}, err)
+	}
+}
+
+func TestCoerceBool(t *testing.T) {
+	b, err := coerceBool("TRUE")
+	assert.Nil(t, err)
+	assert.True(t, b)
+
+	b, err = coerceBool("false")
+	assert.Nil(t, err)
+	assert.False(t, b)
+
+	for _, val := range []interface{}{"yes", "1", float64(1)} {
+		_, err := coerceBool(val)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestCoerceString(t *testing.T) {
+	s, err := coerceString(float64(12))
+	assert.Nil(t, err)
+	assert.Equal(t, "12", s)
+
+	s, err = coerceString(true)
+	assert.Nil(t, err)
+	assert.Equal(t, "true", s)
+
+	_, err = coerceString(map[string]interface{}{"a": 1})
+	assert.Equal(t, "expected a string, got object with 1 keys", err.Error())
+}
+
+func TestCoerceTime(t *testing.T) {
+	expected := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+	for _, val := range []interface{}{"2024-01-08T12:00:00Z", "2024-01-08T13:00:00+01:00", float64(1704715200), "1704715200"} {
+		tm, err := coerceTime(val)
+		assert.Nil(t, err)
+		assert.True(t, expected.Equal(tm), val)
+	}
+
+	_, err := coerceTime("yesterday")
+	assert.NotNil(t, err)
+
+	// Milliseconds since the epoch overflow, they are not taken for seconds
+	for _, val := range []interface{}{float64(1704715200000), "1704715200000", math.Inf(1), math.NaN()} {
+		_, err = coerceTime(val)
+		assert.NotNil(t, err, val)
+	}
+}
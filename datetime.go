@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// receivedKey is the key of rules that check the time we received the event
+// instead of a value in its data
+const receivedKey = "@received"
+
+// validateDatetime checks the value of before/after (a timestamp or a duration
+// relative to now), within_last/within_next (a duration), time_between (two
+// times of day) and weekday_in (day names)
+func (r *rule) validateDatetime() error {
+	_, err := r.timeZone()
+	if err != nil {
+		return err
+	}
+
+	switch r.Setting {
+	case "before", "after":
+		_, err := parseTimeBound(r.Value, time.Now())
+		return err
+	case "within_last", "within_next":
+		d, err := parseRelativeDuration(r.Value)
+		if err != nil {
+			return err
+		}
+		if d <= 0 {
+			return fmt.Errorf("%s needs a positive duration", r.Setting)
+		}
+	case "time_between":
+		if len(r.Values) != 2 {
+			return fmt.Errorf("time_between needs two values")
+		}
+		for _, v := range r.Values {
+			_, err := parseTimeOfDay(v)
+			if err != nil {
+				return err
+			}
+		}
+	case "weekday_in":
+		if len(r.Values) == 0 {
+			return fmt.Errorf("weekday_in needs values")
+		}
+		for _, day := range r.Values {
+			_, ok := weekdays[strings.ToLower(day)]
+			if !ok {
+				return fmt.Errorf("unknown day %q", day)
+			}
+		}
+	}
+	return nil
+}
+
+// timeZone returns the location time_between and weekday_in are checked in,
+// the time zone of the rule or else RuleTimeZone
+func (r *rule) timeZone() (*time.Location, error) {
+	name := r.TimeZone
+	if name == "" {
+		name = C.RuleTimeZone
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time_zone %q", name)
+	}
+	return location, nil
+}
+
+// parseRelativeDuration parses durations like "90m" and "24h", and "7d" for
+// whole days
+func parseRelativeDuration(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err == nil {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// parseTimeBound parses the value of before and after, a timestamp or a
+// duration relative to now like "-24h"
+func parseTimeBound(s string, now time.Time) (time.Time, error) {
+	t, err := coerceTime(s)
+	if err == nil {
+		return t, nil
+	}
+	d, err := parseRelativeDuration(s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("value %q is not a timestamp or duration", s)
+	}
+	return now.Add(d), nil
+}
+
+func metDatetime(r *rule, value interface{}) (bool, error) {
+	val, err := coerceTime(value)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now()
+
+	switch r.Setting {
+	case "before", "after":
+		bound, err := parseTimeBound(r.Value, now)
+		if err != nil {
+			return false, nil
+		}
+		if r.Setting == "before" {
+			return val.Before(bound), nil
+		}
+		return val.After(bound), nil
+	case "within_last", "within_next":
+		d, err := parseRelativeDuration(r.Value)
+		if err != nil {
+			return false, nil
+		}
+		if r.Setting == "within_last" {
+			return !val.After(now) && !val.Before(now.Add(-d)), nil
+		}
+		return !val.Before(now) && !val.After(now.Add(d)), nil
+	case "time_between":
+		if len(r.Values) != 2 {
+			return false, nil
+		}
+		from, err := parseTimeOfDay(r.Values[0])
+		if err != nil {
+			return false, nil
+		}
+		to, err := parseTimeOfDay(r.Values[1])
+		if err != nil {
+			return false, nil
+		}
+		local := val.In(r.loc())
+		minute := local.Hour()*60 + local.Minute()
+		// a range that ends before it starts runs past midnight
+		if from <= to {
+			return minute >= from && minute < to, nil
+		}
+		return minute >= from || minute < to, nil
+	case "weekday_in":
+		weekday := val.In(r.loc()).Weekday()
+		for _, day := range r.Values {
+			if weekdays[strings.ToLower(day)] == weekday {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// loc returns the location loaded by compile, UTC when the time zone of the
+// rule is unknown
+func (r *rule) loc() *time.Location {
+	if r.location != nil {
+		return r.location
+	}
+	location, err := r.timeZone()
+	if err != nil {
+		return time.UTC
+	}
+	return location
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRelativeDuration(t *testing.T) {
+	d, err := parseRelativeDuration("24h")
+	assert.Nil(t, err)
+	assert.Equal(t, 24*time.Hour, d)
+
+	d, err = parseRelativeDuration("7d")
+	assert.Nil(t, err)
+	assert.Equal(t, 7*24*time.Hour, d)
+
+	_, err = parseRelativeDuration("soon")
+	assert.NotNil(t, err)
+}
+
+func TestParseDatetimeRules(t *testing.T) {
+	valid := []string{
+		`[{"key": "signed_up_at", "type": "datetime", "setting": "within_last", "value": "24h"}]`,
+		`[{"key": "signed_up_at", "type": "datetime", "setting": "before", "value": "2015-01-01T00:00:00Z"}]`,
+		`[{"key": "signed_up_at", "type": "datetime", "setting": "after", "value": "-7d"}]`,
+		`[{"key": "@received", "type": "datetime", "setting": "time_between", "values": ["22:00", "06:00"], "time_zone": "Europe/Amsterdam"}]`,
+		`[{"key": "@received", "type": "datetime", "setting": "weekday_in", "values": ["sat", "sun"]}]`,
+	}
+	for _, raw := range valid {
+		_, err := parseRules(types.JSONText(raw))
+		assert.Nil(t, err, raw)
+	}
+
+	invalid := []string{
+		`[{"key": "signed_up_at", "type": "datetime", "setting": "within_last", "value": "yesterday"}]`,
+		`[{"key": "signed_up_at", "type": "datetime", "setting": "within_last", "value": "-24h"}]`,
+		`[{"key": "signed_up_at", "type": "datetime", "setting": "before", "value": "later"}]`,
+		`[{"key": "@received", "type": "datetime", "setting": "time_between", "values": ["22:00"]}]`,
+		`[{"key": "@received", "type": "datetime", "setting": "weekday_in", "values": ["someday"]}]`,
+		`[{"key": "@received", "type": "datetime", "setting": "weekday_in", "values": ["sat"], "time_zone": "Mars/Olympus"}]`,
+	}
+	for _, raw := range invalid {
+		_, err := parseRules(types.JSONText(raw))
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestDatetimeRules(t *testing.T) {
+	now := time.Now()
+	event := setupTestNotifier(types.JSONText(fmt.Sprintf(
+		`{"signed_up_at": %q, "trial_ends_at": %d, "renewed_at": "soon"}`,
+		now.Add(-2*time.Hour).Format(time.RFC3339), now.Add(48*time.Hour).Unix(),
+	)))
+
+	cases := []struct {
+		rule rule
+		met  bool
+	}{
+		{rule{Key: "signed_up_at", Type: "datetime", Setting: "within_last", Value: "24h"}, true},
+		{rule{Key: "signed_up_at", Type: "datetime", Setting: "within_last", Value: "1h"}, false},
+		{rule{Key: "signed_up_at", Type: "datetime", Setting: "within_next", Value: "24h"}, false},
+		{rule{Key: "trial_ends_at", Type: "datetime", Setting: "within_next", Value: "3d"}, true},
+		{rule{Key: "trial_ends_at", Type: "datetime", Setting: "within_next", Value: "1d"}, false},
+		{rule{Key: "signed_up_at", Type: "datetime", Setting: "after", Value: "-3h"}, true},
+		{rule{Key: "signed_up_at", Type: "datetime", Setting: "before", Value: "-3h"}, false},
+		{rule{Key: "signed_up_at", Type: "datetime", Setting: "after", Value: "2015-01-01T00:00:00Z"}, true},
+		{rule{Key: "trial_ends_at", Type: "datetime", Setting: "before", Value: "1420070400"}, false},
+		{rule{Key: "renewed_at", Type: "datetime", Setting: "within_last", Value: "24h"}, false},
+	}
+	for _, c := range cases {
+		c.rule.compile()
+		assert.Equal(t, c.met, c.rule.Met(&event), c.rule.String())
+	}
+}
+
+func TestDatetimeRulesOnReceivedTime(t *testing.T) {
+	event := setupTestNotifier(types.JSONText(`{}`))
+	// Saturday 23:30 in Amsterdam
+	event.ReceivedAt = time.Date(2024, 3, 2, 22, 30, 0, 0, time.UTC)
+
+	cases := []struct {
+		rule rule
+		met  bool
+	}{
+		{rule{Key: receivedKey, Type: "datetime", Setting: "time_between", Values: []string{"22:00", "23:00"}}, true},
+		{rule{Key: receivedKey, Type: "datetime", Setting: "time_between", Values: []string{"22:00", "23:00"}, TimeZone: "Europe/Amsterdam"}, false},
+		{rule{Key: receivedKey, Type: "datetime", Setting: "time_between", Values: []string{"23:00", "06:00"}, TimeZone: "Europe/Amsterdam"}, true},
+		{rule{Key: receivedKey, Type: "datetime", Setting: "weekday_in", Values: []string{"sat", "sun"}}, true},
+		{rule{Key: receivedKey, Type: "datetime", Setting: "weekday_in", Values: []string{"Mon"}}, false},
+		{rule{Key: receivedKey, Type: "datetime", Setting: "within_last", Value: "1h"}, false},
+	}
+	for _, c := range cases {
+		c.rule.compile()
+		assert.Equal(t, c.met, c.rule.Met(&event), c.rule.String())
+	}
+}
+
+func TestRuleTimeZoneFallsBackToConfig(t *testing.T) {
+	defer func(tz string) { C.RuleTimeZone = tz }(C.RuleTimeZone)
+	C.RuleTimeZone = "Asia/Tokyo"
+
+	event := setupTestNotifier(types.JSONText(`{}`))
+	// Saturday 22:30 in UTC is Sunday in Tokyo
+	event.ReceivedAt = time.Date(2024, 3, 2, 22, 30, 0, 0, time.UTC)
+
+	r := rule{Key: receivedKey, Type: "datetime", Setting: "weekday_in", Values: []string{"sun"}}
+	r.compile()
+	assert.Equal(t, true, r.Met(&event))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/bittersweet/notifilter-receive/notifiers"
+)
+
+// deadLetter is a notification that could not be delivered, even after
+// retrying. It holds the rendered message so it can be re-driven later on.
+type deadLetter struct {
+	ID               int        `db:"id" json:"id"`
+	NotifierID       int        `db:"notifier_id" json:"notifier_id"`
+	RequestID        string     `db:"request_id" json:"request_id"`
+	NotificationType string     `db:"notification_type" json:"notification_type"`
+	Target           string     `db:"target" json:"target"`
+	EventName        string     `db:"event_name" json:"event_name"`
+	Message          string     `db:"message" json:"message"`
+	Error            string     `db:"error" json:"error"`
+	Response         string     `db:"response" json:"response"`
+	Attempts         int        `db:"attempts" json:"attempts"`
+	CreatedAt        time.Time  `db:"created_at" json:"created_at"`
+	RedrivenAt       *time.Time `db:"redriven_at" json:"redriven_at"`
+}
+
+func newDeadLetter(n *Notifier, e *Event, message []byte, res notifiers.DeliveryResult, attempts int) deadLetter {
+	return deadLetter{
+		NotifierID:       n.ID,
+		RequestID:        e.requestID,
+		NotificationType: n.NotificationType,
+		Target:           n.Target,
+		EventName:        n.EventName,
+		Message:          string(message),
+		Error:            res.Err.Error(),
+		Response:         res.Response,
+		Attempts:         attempts,
+	}
+}
+
+// saveDeadLetter stores a failed notification, when we have no database it is
+// only logged
+func saveDeadLetter(dl deadLetter) {
+	if db == nil {
+		logRequest(dl.RequestID, "[NOTIFY] Dropping dead letter for notifier id: %d, there is no database to save it in", dl.NotifierID)
+		return
+	}
+
+	_, err := db.NamedExec(`INSERT INTO dead_letters
+		(notifier_id, request_id, notification_type, target, event_name, message, error, response, attempts)
+		VALUES (:notifier_id, :request_id, :notification_type, :target, :event_name, :message, :error, :response, :attempts)`, dl)
+	if err != nil {
+		logRequest(dl.RequestID, "[NOTIFY] Could not save dead letter for notifier id: %d: %s", dl.NotifierID, err)
+		return
+	}
+	logRequest(dl.RequestID, "[NOTIFY] Saved dead letter for notifier id: %d after %d attempts", dl.NotifierID, dl.Attempts)
+}
+
+// listDeadLetters returns the most recent dead letters first
+func listDeadLetters(limit int) ([]deadLetter, error) {
+	dls := []deadLetter{}
+	err := db.Select(&dls, "SELECT * FROM dead_letters ORDER BY id DESC LIMIT $1", limit)
+	return dls, err
+}
+
+// oldestDeadLetters returns the oldest dead letters first
+func oldestDeadLetters(limit int) ([]deadLetter, error) {
+	dls := []deadLetter{}
+	err := db.Select(&dls, "SELECT * FROM dead_letters ORDER BY id ASC LIMIT $1", limit)
+	return dls, err
+}
+
+// getDeadLetter returns sql.ErrNoRows when there is no dead letter with id
+func getDeadLetter(id int) (deadLetter, error) {
+	var dl deadLetter
+	err := db.Get(&dl, "SELECT * FROM dead_letters WHERE id=$1", id)
+	return dl, err
+}
+
+// redrive sends a dead letter again. It is removed when it is delivered,
+// otherwise its error and attempts are updated.
+func redrive(dl deadLetter) (notifiers.DeliveryResult, error) {
+	n := Notifier{
+		ID:               dl.NotifierID,
+		NotificationType: dl.NotificationType,
+		Target:           dl.Target,
+		EventName:        dl.EventName,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout())
+	defer cancel()
+	res := n.newNotifier().SendMessage(ctx, dl.Target, dl.EventName, []byte(dl.Message))
+	observeNotification(dl.NotificationType, res.Err)
+
+	if res.Err == nil {
+		logRequest(dl.RequestID, "[NOTIFY] Re-drove dead letter %d for notifier id: %d", dl.ID, dl.NotifierID)
+		_, err := db.Exec("DELETE FROM dead_letters WHERE id=$1", dl.ID)
+		return res, err
+	}
+
+	logRequest(dl.RequestID, "[NOTIFY] Re-driving dead letter %d failed: %s", dl.ID, res.Err)
+	_, err := db.Exec("UPDATE dead_letters SET error=$1, response=$2, attempts=attempts+1, redriven_at=$3 WHERE id=$4",
+		res.Err.Error(), res.Response, time.Now(), dl.ID)
+	return res, err
+}
+
+// isNotFound tells whether err means a record does not exist
+func isNotFound(err error) bool {
+	return err == sql.ErrNoRows
+}
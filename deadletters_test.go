@@ -0,0 +1,160 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bittersweet/notifilter-receive/notifiers"
+	"github.com/jmoiron/sqlx"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSchema has the tables of schema.sql we need in a SQLite database
+const testSchema = `CREATE TABLE dead_letters(
+  id integer primary key autoincrement,
+  notifier_id integer,
+  request_id text,
+  notification_type text,
+  target text,
+  event_name text,
+  message text,
+  error text,
+  response text,
+  attempts integer,
+  created_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP,
+  redriven_at timestamp
+);
+CREATE TABLE deliveries(
+  id integer primary key autoincrement,
+  request_id text,
+  notifier_id integer,
+  matched boolean NOT NULL DEFAULT false,
+  failed_rule text NOT NULL DEFAULT '',
+  message text NOT NULL DEFAULT '',
+  channel text,
+  target text,
+  status text,
+  error text NOT NULL DEFAULT '',
+  response text NOT NULL DEFAULT '',
+  attempts integer NOT NULL DEFAULT 0,
+  created_at timestamp NOT NULL,
+  finished_at timestamp NOT NULL
+);`
+
+// setupTestDB replaces db with an in-memory SQLite database for the duration
+// of the test
+func setupTestDB(t *testing.T) {
+	testDB := sqlx.MustConnect("sqlite3", ":memory:")
+	// every connection to :memory: is a new database
+	testDB.SetMaxOpenConns(1)
+	testDB.MustExec(testSchema)
+
+	previous := db
+	db = testDB
+	t.Cleanup(func() {
+		db = previous
+		testDB.Close()
+	})
+}
+
+func TestDeadLetterRoutes(t *testing.T) {
+	setupTestDB(t)
+	mn := &LocalMessageNotifier{}
+	notificationChannels["local"] = func() notifiers.MessageNotifier { return mn }
+	defer delete(notificationChannels, "local")
+
+	saveDeadLetter(deadLetter{NotifierID: 1, RequestID: "abc", NotificationType: "local", Message: "first", Error: "timeout", Attempts: 4})
+	saveDeadLetter(deadLetter{NotifierID: 1, RequestID: "def", NotificationType: "slack", Message: "second", Error: "timeout", Attempts: 4})
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, true)
+
+	request, _ := http.NewRequest("GET", "/v1/dead_letters", nil)
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	dls := []deadLetter{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &dls))
+	assert.Equal(t, 2, len(dls))
+	assert.Equal(t, "second", dls[0].Message)
+
+	request, _ = http.NewRequest("GET", "/v1/dead_letters/1", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"message": "first"`)
+
+	request, _ = http.NewRequest("GET", "/v1/dead_letters/3", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	request, _ = http.NewRequest("POST", "/v1/dead_letters/first/redrive", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	request, _ = http.NewRequest("POST", "/v1/dead_letters/1/redrive", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "first", string(mn.Message))
+	_, err := getDeadLetter(1)
+	assert.True(t, isNotFound(err))
+}
+
+func TestRedriveAllOldestFirst(t *testing.T) {
+	setupTestDB(t)
+	mn := &recordingMessageNotifier{}
+	notificationChannels["local"] = func() notifiers.MessageNotifier { return mn }
+	defer delete(notificationChannels, "local")
+
+	for _, message := range []string{"first", "second", "third"} {
+		saveDeadLetter(deadLetter{NotifierID: 1, NotificationType: "local", Message: message, Error: "timeout"})
+	}
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, true)
+	request, _ := http.NewRequest("POST", "/v1/dead_letters/redrive?limit=2", nil)
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Contains(t, response.Body.String(), `"queued": 2`)
+
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&redriving) == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []string{"first", "second"}, mn.messages())
+
+	dls, err := listDeadLetters(10)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(dls))
+	assert.Equal(t, "third", dls[0].Message)
+}
+
+// recordingMessageNotifier keeps every message it was asked to send
+type recordingMessageNotifier struct {
+	mu   sync.Mutex
+	sent []string
+}
+
+func (mn *recordingMessageNotifier) SendMessage(ctx context.Context, target string, eventName string, data []byte) notifiers.DeliveryResult {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	mn.sent = append(mn.sent, string(data))
+	return notifiers.DeliveryResult{}
+}
+
+func (mn *recordingMessageNotifier) messages() []string {
+	mn.mu.Lock()
+	defer mn.mu.Unlock()
+	return mn.sent
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"time"
+)
+
+// Statuses of a delivery
+const (
+	deliveryNotMatched = "not_matched"
+	deliveryDelivered  = "delivered"
+	deliveryFailed     = "failed"
+	deliveryError      = "error"
+	deliverySuppressed = "suppressed"
+)
+
+// delivery records the evaluation of a single notifier against an event, so
+// we can tell whether and why a notifier did or did not fire
+type delivery struct {
+	ID         int       `db:"id" json:"id"`
+	RequestID  string    `db:"request_id" json:"request_id"`
+	NotifierID int       `db:"notifier_id" json:"notifier_id"`
+	Matched    bool      `db:"matched" json:"matched"`
+	FailedRule string    `db:"failed_rule" json:"failed_rule"`
+	Message    string    `db:"message" json:"message"`
+	Channel    string    `db:"channel" json:"channel"`
+	Target     string    `db:"target" json:"target"`
+	Status     string    `db:"status" json:"status"`
+	Error      string    `db:"error" json:"error"`
+	Response   string    `db:"response" json:"response"`
+	Attempts   int       `db:"attempts" json:"attempts"`
+	CreatedAt  time.Time `db:"created_at" json:"created_at"`
+	FinishedAt time.Time `db:"finished_at" json:"finished_at"`
+}
+
+// saveDelivery adds a delivery to the log, when we have no database (in
+// tests) it is skipped
+func saveDelivery(d delivery) {
+	if db == nil {
+		return
+	}
+
+	_, err := db.NamedExec(`INSERT INTO deliveries
+		(request_id, notifier_id, matched, failed_rule, message, channel, target, status, error, response, attempts, created_at, finished_at)
+		VALUES (:request_id, :notifier_id, :matched, :failed_rule, :message, :channel, :target, :status, :error, :response, :attempts, :created_at, :finished_at)`, d)
+	if err != nil {
+		logRequest(d.RequestID, "[NOTIFY] Could not save delivery for notifier id: %d: %s", d.NotifierID, err)
+	}
+}
+
+// deliveriesForNotifier returns the most recent deliveries of a notifier first
+func deliveriesForNotifier(notifierID int, limit int) ([]delivery, error) {
+	ds := []delivery{}
+	err := db.Select(&ds, "SELECT * FROM deliveries WHERE notifier_id=$1 ORDER BY id DESC LIMIT $2", notifierID, limit)
+	return ds, err
+}
+
+// deliveriesForRequest returns the deliveries of all notifiers for an event
+func deliveriesForRequest(requestID string) ([]delivery, error) {
+	ds := []delivery{}
+	err := db.Select(&ds, "SELECT * FROM deliveries WHERE request_id=$1 ORDER BY id", requestID)
+	return ds, err
+}
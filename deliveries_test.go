@@ -0,0 +1,48 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeliveryRoutes(t *testing.T) {
+	setupTestDB(t)
+	now := time.Now()
+	saveDelivery(delivery{RequestID: "abc", NotifierID: 1, Status: deliveryNotMatched, CreatedAt: now, FinishedAt: now})
+	saveDelivery(delivery{RequestID: "abc", NotifierID: 2, Matched: true, Status: deliveryDelivered, CreatedAt: now, FinishedAt: now})
+	saveDelivery(delivery{RequestID: "def", NotifierID: 2, Matched: true, Status: deliveryFailed, CreatedAt: now, FinishedAt: now})
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, true)
+
+	request, _ := http.NewRequest("GET", "/v1/notifiers/2/deliveries", nil)
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	ds := []delivery{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &ds))
+	assert.Equal(t, 2, len(ds))
+	assert.Equal(t, "def", ds[0].RequestID)
+
+	request, _ = http.NewRequest("GET", "/v1/events/abc/deliveries", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	ds = []delivery{}
+	assert.Nil(t, json.Unmarshal(response.Body.Bytes(), &ds))
+	assert.Equal(t, 2, len(ds))
+	assert.Equal(t, deliveryNotMatched, ds[0].Status)
+	assert.Equal(t, deliveryDelivered, ds[1].Status)
+
+	request, _ = http.NewRequest("GET", "/v1/notifiers/all/deliveries", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
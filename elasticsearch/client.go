@@ -3,6 +3,7 @@ package elasticsearch
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -64,6 +65,45 @@ func (c *Client) Persist(requestID string, application string, name string, data
 	return nil
 }
 
+// Health checks that the cluster is not red and that our index exists
+func (c *Client) Health(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", fmt.Sprintf("http://%s:%d/_cluster/health", c.Host, c.Port), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var health struct {
+		Status string `json:"status"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&health)
+	if err != nil {
+		return err
+	}
+	if health.Status == "red" {
+		return errors.New("cluster status is red")
+	}
+
+	req, err = http.NewRequestWithContext(ctx, "HEAD", fmt.Sprintf("http://%s:%d/%s", c.Host, c.Port, c.Index), nil)
+	if err != nil {
+		return err
+	}
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("index %s returned status %d", c.Index, resp.StatusCode)
+	}
+
+	return nil
+}
+
 // EventCount returns the total amount of events persisted to Elasticsearch
 func (c *Client) EventCount() (int, error) {
 	type response struct {
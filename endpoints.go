@@ -1,10 +1,17 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bittersweet/notifilter-receive/elasticsearch"
@@ -16,11 +23,134 @@ type previewData struct {
 	Data     types.JSONText `json:"data"`
 }
 
+// enqueueTimeout is how long an HTTP sender waits for the incoming loop to pick
+// up its event before we give up and tell it to come back later
+const enqueueTimeout = 5 * time.Second
+
 func trackTime(start time.Time, name string) {
 	elapsed := time.Since(start)
 	log.Printf("%s took %s\n", name, elapsed)
 }
 
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	output, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		log.Println("Error in writeJSON MarshalIndent", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+// handleEvents accepts the same Event JSON as our UDP listener, but replies
+// with the request ID the event was queued under
+func handleEvents(incomingChan chan<- incomingItem) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer trackTime(time.Now(), "handleEvents")
+
+		if r.Method != "POST" {
+			w.Header().Set("Allow", "POST")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		payload, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxPacketSize))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			rejections.reject(rejectOversized, err, nil)
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			log.Println("Error reading /v1/events body", err)
+			rejections.reject(rejectReadError, err, nil)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		result := make(chan []queueResult, 1)
+		select {
+		case incomingChan <- incomingItem{payload: payload, result: result}:
+		case <-time.After(enqueueTimeout):
+			http.Error(w, "event pipeline is not accepting events", http.StatusServiceUnavailable)
+			return
+		}
+
+		results := <-result
+		if len(results) == 0 {
+			http.Error(w, "no events in payload", http.StatusBadRequest)
+			return
+		}
+
+		// A single event gets a single request ID back, batches get a result
+		// per line so the sender knows which lines to fix or retry
+		if len(results) == 1 {
+			res := results[0]
+			if res.err != nil {
+				writeQueueError(w, res.err)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, map[string]string{
+				"request_id": res.requestID,
+			})
+			return
+		}
+
+		response := batchResponse{Events: []eventResponse{}}
+		var queueFull bool
+		for _, res := range results {
+			er := eventResponse{Line: res.line, RequestID: res.requestID}
+			if res.err != nil {
+				er.Error = res.err.Error()
+				response.Rejected++
+				queueFull = queueFull || res.err == errQueueFull
+			} else {
+				response.Accepted++
+			}
+			response.Events = append(response.Events, er)
+		}
+
+		status := http.StatusAccepted
+		if response.Accepted == 0 {
+			status = http.StatusBadRequest
+			if queueFull {
+				w.Header().Set("Retry-After", "1")
+				status = http.StatusTooManyRequests
+			}
+		}
+		writeJSON(w, status, response)
+	})
+}
+
+// batchResponse is returned when a JSON Lines batch was posted to /v1/events
+type batchResponse struct {
+	Accepted int             `json:"accepted"`
+	Rejected int             `json:"rejected"`
+	Events   []eventResponse `json:"events"`
+}
+
+type eventResponse struct {
+	Line      int    `json:"line"`
+	RequestID string `json:"request_id,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+func writeQueueError(w http.ResponseWriter, err error) {
+	switch err {
+	case errQueueFull:
+		w.Header().Set("Retry-After", "1")
+		http.Error(w, err.Error(), http.StatusTooManyRequests)
+		return
+	case errSpoolUnavailable, errShuttingDown:
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadRequest)
+}
+
 func handleCount(es elasticsearch.ElasticsearchClient) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer trackTime(time.Now(), "handleCount")
@@ -78,7 +208,241 @@ func handlePreview() http.Handler {
 	})
 }
 
-func handleStatistics(t time.Time) http.Handler {
+// readinessCheck reports whether one of the dependencies we need to process
+// events is healthy
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+type checkResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+// handleHealth tells whether the process is alive, it does not check any of
+// our dependencies
+func handleHealth() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+}
+
+// handleReady runs all checks concurrently and responds with 503 when any of
+// them failed, so this instance stops receiving traffic
+func handleReady(timeout time.Duration, checks ...readinessCheck) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		results := map[string]checkResult{}
+		for _, c := range checks {
+			wg.Add(1)
+			go func(c readinessCheck) {
+				defer wg.Done()
+				start := time.Now()
+				err := c.check(ctx)
+				res := checkResult{
+					Status:    "ok",
+					LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+				}
+				if err != nil {
+					res.Status = "unavailable"
+					res.Error = err.Error()
+				}
+
+				mu.Lock()
+				results[c.name] = res
+				mu.Unlock()
+			}(c)
+		}
+		wg.Wait()
+
+		status := "ok"
+		code := http.StatusOK
+		for _, res := range results {
+			if res.Error != "" {
+				status = "unavailable"
+				code = http.StatusServiceUnavailable
+			}
+		}
+
+		writeJSON(w, code, struct {
+			Status string                 `json:"status"`
+			Checks map[string]checkResult `json:"checks"`
+		}{status, results})
+	})
+}
+
+// pathID parses the {id} wildcard of the request path
+func pathID(r *http.Request) (int, error) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return 0, fmt.Errorf("invalid id %q", r.PathValue("id"))
+	}
+	return id, nil
+}
+
+// queryLimit parses the limit query parameter, capped to max
+func queryLimit(r *http.Request, def int, max int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit < 1 {
+		return def
+	}
+	if limit > max {
+		return max
+	}
+	return limit
+}
+
+func handleDeadLetters() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		dls, err := listDeadLetters(queryLimit(r, 100, 1000))
+		if err != nil {
+			log.Println("Error listing dead letters", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, dls)
+	})
+}
+
+func handleDeadLetter() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dl, err := getDeadLetter(id)
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println("Error getting dead letter", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, dl)
+	})
+}
+
+// handleRedrive sends a single dead letter again
+func handleRedrive() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer trackTime(time.Now(), "handleRedrive")
+
+		id, err := pathID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		dl, err := getDeadLetter(id)
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println("Error getting dead letter", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res, err := redrive(dl)
+		if err != nil {
+			log.Println("Error updating dead letter", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if res.Err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{
+				"error":    res.Err.Error(),
+				"response": res.Response,
+			})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"response": res.Response})
+	})
+}
+
+// redriving is set while dead letters are re-driven in the background
+var redriving int32
+
+// handleRedriveAll sends the oldest dead letters again in the background, to
+// recover from an outage of Slack or our SMTP server. Only one batch is
+// re-driven at a time.
+func handleRedriveAll() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer trackTime(time.Now(), "handleRedriveAll")
+
+		if !atomic.CompareAndSwapInt32(&redriving, 0, 1) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": "dead letters are already being re-driven"})
+			return
+		}
+
+		dls, err := oldestDeadLetters(queryLimit(r, 100, 1000))
+		if err != nil {
+			atomic.StoreInt32(&redriving, 0)
+			log.Println("Error listing dead letters", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		go func() {
+			defer atomic.StoreInt32(&redriving, 0)
+
+			redriven, failed := 0, 0
+			for _, dl := range dls {
+				res, err := redrive(dl)
+				if err != nil || res.Err != nil {
+					failed++
+					continue
+				}
+				redriven++
+			}
+			log.Printf("Re-drove %d dead letters, %d failed\n", redriven, failed)
+		}()
+		writeJSON(w, http.StatusAccepted, map[string]int{"queued": len(dls)})
+	})
+}
+
+func handleNotifierDeliveries() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ds, err := deliveriesForNotifier(id, queryLimit(r, 100, 1000))
+		if err != nil {
+			log.Println("Error listing deliveries", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ds)
+	})
+}
+
+func handleEventDeliveries() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ds, err := deliveriesForRequest(r.PathValue("requestID"))
+		if err != nil {
+			log.Println("Error listing deliveries", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, ds)
+	})
+}
+
+func handleStatistics(t time.Time, p *pipeline) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		m := new(runtime.MemStats)
 		runtime.ReadMemStats(m)
@@ -89,12 +453,18 @@ func handleStatistics(t time.Time) http.Handler {
 			Alloc        uint64 // bytes allocated and not yet freed
 			TotalAlloc   uint64 // bytes allocated (even if freed)
 			Sys          uint64 // bytes obtained from system
+			Pools        []poolStats
+			Rejections   rejectionCounts
+			Rejected     []rejectedPayload // sample of recently rejected payloads
 		}{
 			Uptime:       time.Now().Unix() - t.Unix(),
 			NumGoroutine: runtime.NumGoroutine(),
 			Alloc:        m.Alloc,
 			TotalAlloc:   m.TotalAlloc,
 			Sys:          m.Sys,
+			Pools:        p.stats(),
+			Rejections:   rejections.counters(),
+			Rejected:     rejections.recent(),
 		}
 
 		output, err := json.MarshalIndent(systemStatus, "", "  ")
@@ -107,3 +477,212 @@ func handleStatistics(t time.Time) http.Handler {
 		w.Write(output)
 	})
 }
+
+// newNotifier returns a notifier with the defaults for fields a request body
+// leaves out
+func newNotifier() Notifier {
+	return Notifier{MaxRetries: 3, Rules: types.JSONText("[]"), Enabled: true, Schedule: types.JSONText("[]"), Throttle: types.JSONText("{}")}
+}
+
+// decodeNotifier reads the request body over n and validates the result. The
+// source and file key of n are kept, only syncing files sets them.
+func decodeNotifier(w http.ResponseWriter, r *http.Request, n Notifier) (Notifier, error) {
+	source, fileKey := n.Source, n.FileKey
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&n)
+	if err != nil {
+		return n, err
+	}
+	n.Source, n.FileKey = source, fileKey
+	return n, n.validate()
+}
+
+func handleNotifiers() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notifiers, err := notifierStore.List()
+		if err != nil {
+			log.Println("Error listing notifiers", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, notifiers)
+	})
+}
+
+func handleNotifier() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		n, err := notifierStore.Get(id)
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println("Error getting notifier", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, http.StatusOK, n)
+	})
+}
+
+func handleCreateNotifier() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := decodeNotifier(w, r, newNotifier())
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+
+		err = notifierStore.Create(&n)
+		if err != nil {
+			log.Println("Error creating notifier", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		refreshNotifiers()
+		writeJSON(w, http.StatusCreated, n)
+	})
+}
+
+func handleUpdateNotifier() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		stored, err := notifierStore.Get(id)
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println("Error getting notifier", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// A replacement keeps being disabled or snoozed unless the body says
+		// otherwise, those are changed through snooze and resume
+		n := newNotifier()
+		n.Enabled = stored.Enabled
+		n.SnoozedUntil = stored.SnoozedUntil
+		n.Source = stored.Source
+		n.FileKey = stored.FileKey
+		n, err = decodeNotifier(w, r, n)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		n.ID = id
+
+		err = notifierStore.Update(n)
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println("Error updating notifier", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		refreshNotifiers()
+		writeJSON(w, http.StatusOK, n)
+	})
+}
+
+func handleDeleteNotifier() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id, err := pathID(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		err = notifierStore.Delete(id)
+		if isNotFound(err) {
+			http.NotFound(w, r)
+			return
+		}
+		if err != nil {
+			log.Println("Error deleting notifier", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		refreshNotifiers()
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// snoozeRequest is the body of a snooze request, Duration is parsed with
+// time.ParseDuration
+type snoozeRequest struct {
+	Duration string `json:"duration"`
+}
+
+// handleSnoozeNotifier stops checking a notifier for a while
+func handleSnoozeNotifier() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req snoozeRequest
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		duration, err := time.ParseDuration(req.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(w, fmt.Sprintf("invalid duration %q", req.Duration), http.StatusBadRequest)
+			return
+		}
+
+		until := time.Now().Add(duration)
+		changeNotifier(w, r, func(n *Notifier) {
+			n.SnoozedUntil = &until
+		})
+	})
+}
+
+// handleResumeNotifier enables a notifier and ends its snooze
+func handleResumeNotifier() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		changeNotifier(w, r, func(n *Notifier) {
+			n.Enabled = true
+			n.SnoozedUntil = nil
+		})
+	})
+}
+
+// changeNotifier applies change to the notifier in the path and responds
+// with the result
+func changeNotifier(w http.ResponseWriter, r *http.Request, change func(n *Notifier)) {
+	id, err := pathID(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	n, err := notifierStore.Get(id)
+	if err == nil {
+		change(&n)
+		err = notifierStore.Update(n)
+	}
+	if isNotFound(err) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("Error changing notifier", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	refreshNotifiers()
+	writeJSON(w, http.StatusOK, n)
+}
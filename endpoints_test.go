@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -32,3 +36,216 @@ func TestCountStatus(t *testing.T) {
 
 	assert.Equal(t, http.StatusOK, response.Code)
 }
+
+// fakeIncoming answers every incoming item with the given results
+func fakeIncoming(res ...queueResult) chan<- incomingItem {
+	incomingChan := make(chan incomingItem)
+	go func() {
+		for item := range incomingChan {
+			item.result <- res
+		}
+	}()
+	return incomingChan
+}
+
+func TestEventsAccepted(t *testing.T) {
+	eventsHandle := handleEvents(fakeIncoming(queueResult{requestID: "abc"}))
+	body := strings.NewReader(`{"application": "app", "identifier": "signup", "data": {}}`)
+	request, _ := http.NewRequest("POST", "/v1/events", body)
+	response := httptest.NewRecorder()
+	eventsHandle.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Contains(t, response.Body.String(), `"request_id": "abc"`)
+}
+
+func TestEventsQueueFull(t *testing.T) {
+	eventsHandle := handleEvents(fakeIncoming(queueResult{err: errQueueFull}))
+	request, _ := http.NewRequest("POST", "/v1/events", strings.NewReader(`{}`))
+	response := httptest.NewRecorder()
+	eventsHandle.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusTooManyRequests, response.Code)
+}
+
+func TestEventsOnlyAcceptsPost(t *testing.T) {
+	eventsHandle := handleEvents(fakeIncoming())
+	request, _ := http.NewRequest("GET", "/v1/events", nil)
+	response := httptest.NewRecorder()
+	eventsHandle.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+}
+
+func TestEventsBatch(t *testing.T) {
+	eventsHandle := handleEvents(fakeIncoming(
+		queueResult{line: 1, requestID: "abc"},
+		queueResult{line: 2, err: errors.New("invalid character")},
+	))
+	request, _ := http.NewRequest("POST", "/v1/events", strings.NewReader("{}\n{"))
+	response := httptest.NewRecorder()
+	eventsHandle.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusAccepted, response.Code)
+	assert.Contains(t, response.Body.String(), `"accepted": 1`)
+	assert.Contains(t, response.Body.String(), `"error": "invalid character"`)
+}
+
+func TestHealthz(t *testing.T) {
+	request, _ := http.NewRequest("GET", "/healthz", nil)
+	response := httptest.NewRecorder()
+	handleHealth().ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+func TestReadyAllHealthy(t *testing.T) {
+	readyHandle := handleReady(time.Second,
+		readinessCheck{"postgres", func(ctx context.Context) error { return nil }},
+	)
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	response := httptest.NewRecorder()
+	readyHandle.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"postgres": {`)
+}
+
+func TestReadyUnhealthy(t *testing.T) {
+	readyHandle := handleReady(time.Second,
+		readinessCheck{"postgres", func(ctx context.Context) error { return nil }},
+		readinessCheck{"elasticsearch", func(ctx context.Context) error { return errors.New("connection refused") }},
+	)
+	request, _ := http.NewRequest("GET", "/readyz", nil)
+	response := httptest.NewRecorder()
+	readyHandle.ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	assert.Contains(t, response.Body.String(), `"error": "connection refused"`)
+}
+
+func TestCreateNotifierValidates(t *testing.T) {
+	body := `{"application": "", "event_name": "signup", "template": "{{ .name ", "notification_type": "pigeon",
+		"rules": [{"key": "number", "type": "number", "setting": "gte", "value": "ten"}]}`
+	request, _ := http.NewRequest("POST", "/v1/notifiers", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	handleCreateNotifier().ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	for _, msg := range []string{"application is required", "unknown notification_type", "invalid template", "invalid rules"} {
+		assert.Contains(t, response.Body.String(), msg)
+	}
+}
+
+func TestCreateNotifierRejectsUnknownFields(t *testing.T) {
+	body := `{"application": "app", "event_name": "signup", "notification_type": "slack", "channel": "#general"}`
+	request, _ := http.NewRequest("POST", "/v1/notifiers", strings.NewReader(body))
+	response := httptest.NewRecorder()
+	handleCreateNotifier().ServeHTTP(response, request)
+
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), "unknown field")
+}
+
+func TestNotifierRoutes(t *testing.T) {
+	defer func(s NotifierStore) { notifierStore = s }(notifierStore)
+	notifierStore = newMemoryNotifierStore()
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, false)
+	serve := func(method string, path string, body string) *httptest.ResponseRecorder {
+		request, _ := http.NewRequest(method, path, strings.NewReader(body))
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		return response
+	}
+
+	response := serve("POST", "/v1/notifiers", `{"application": "app", "event_name": "signup", "notification_type": "slack", "target": "#general", "source": "file", "file_key": "signups"}`)
+	assert.Equal(t, http.StatusCreated, response.Code)
+	n, _ := notifierStore.Get(1)
+	assert.Equal(t, "", n.Source)
+	assert.Equal(t, "", n.FileKey)
+
+	response = serve("GET", "/v1/notifiers", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"target": "#general"`)
+
+	response = serve("PUT", "/v1/notifiers/1", `{"application": "app", "event_name": "signup", "notification_type": "slack", "target": "#signups"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = serve("GET", "/v1/notifiers/1", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"target": "#signups"`)
+
+	response = serve("PATCH", "/v1/notifiers/1", "")
+	assert.Equal(t, http.StatusMethodNotAllowed, response.Code)
+
+	response = serve("DELETE", "/v1/notifiers/1", "")
+	assert.Equal(t, http.StatusNoContent, response.Code)
+
+	response = serve("GET", "/v1/notifiers/1", "")
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestSnoozeAndResumeNotifier(t *testing.T) {
+	defer func(s NotifierStore) { notifierStore = s }(notifierStore)
+	notifierStore = newMemoryNotifierStore()
+	n := Notifier{Application: "app", EventName: "signup", NotificationType: "slack"}
+	notifierStore.Create(&n)
+
+	mux := http.NewServeMux()
+	registerRoutes(mux, false)
+
+	request, _ := http.NewRequest("POST", "/v1/notifiers/1/snooze", strings.NewReader(`{"duration": "2h"}`))
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	n, _ = notifierStore.Get(1)
+	assert.True(t, n.SnoozedUntil.After(time.Now().Add(time.Hour)))
+
+	request, _ = http.NewRequest("POST", "/v1/notifiers/1/resume", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	n, _ = notifierStore.Get(1)
+	assert.Nil(t, n.SnoozedUntil)
+	assert.True(t, n.Enabled)
+
+	request, _ = http.NewRequest("POST", "/v1/notifiers/1/snooze", strings.NewReader(`{"duration": "2h"}`))
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	request, _ = http.NewRequest("PUT", "/v1/notifiers/1", strings.NewReader(`{"application": "app", "event_name": "signup", "notification_type": "slack", "target": "#signups"}`))
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	n, _ = notifierStore.Get(1)
+	assert.Equal(t, "#signups", n.Target)
+	assert.NotNil(t, n.SnoozedUntil)
+
+	request, _ = http.NewRequest("PUT", "/v1/notifiers/1", strings.NewReader(`{"application": "app", "event_name": "signup", "notification_type": "slack", "enabled": false, "snoozed_until": null}`))
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	n, _ = notifierStore.Get(1)
+	assert.False(t, n.Enabled)
+	assert.Nil(t, n.SnoozedUntil)
+
+	request, _ = http.NewRequest("PUT", "/v1/notifiers/1", strings.NewReader(`{"application": "app", "event_name": "signup", "notification_type": "slack"}`))
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusOK, response.Code)
+	n, _ = notifierStore.Get(1)
+	assert.False(t, n.Enabled)
+
+	request, _ = http.NewRequest("POST", "/v1/notifiers/2/resume", nil)
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	request, _ = http.NewRequest("POST", "/v1/notifiers/1/snooze", strings.NewReader(`{"duration": "soon"}`))
+	response = httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pathSegment is one step of a key path, either a key of an object or an
+// index of an array. A wildcard index visits every item.
+type pathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// parseKeyPath splits a path like order.items[0].sku or items[*].price into
+// its segments
+func parseKeyPath(path string) ([]pathSegment, error) {
+	if path == "" {
+		return nil, fmt.Errorf("empty path")
+	}
+
+	segments := []pathSegment{}
+	for _, part := range strings.Split(path, ".") {
+		name, rest := part, ""
+		if i := strings.Index(part, "["); i >= 0 {
+			name, rest = part[:i], part[i:]
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty key in %q", path)
+		}
+		segments = append(segments, pathSegment{key: name})
+
+		for rest != "" {
+			end := strings.Index(rest, "]")
+			if rest[0] != '[' || end < 0 {
+				return nil, fmt.Errorf("invalid index in %q", path)
+			}
+			index := rest[1:end]
+			rest = rest[end+1:]
+
+			if index == "*" {
+				segments = append(segments, pathSegment{isIndex: true, wildcard: true})
+				continue
+			}
+			i, err := strconv.Atoi(index)
+			if err != nil || i < 0 {
+				return nil, fmt.Errorf("invalid index %q in %q", index, path)
+			}
+			segments = append(segments, pathSegment{isIndex: true, index: i})
+		}
+	}
+	return segments, nil
+}
+
+// lookupPath returns the values at path in data. A path without wildcards
+// has at most one value, found is false when nothing is at the path. Keys that
+// contain dots themselves are still found when they are at the top level.
+func lookupPath(data map[string]interface{}, path string) (values []interface{}, found bool) {
+	if v, ok := data[path]; ok {
+		return []interface{}{v}, true
+	}
+
+	segments, err := parseKeyPath(path)
+	if err != nil {
+		return nil, false
+	}
+
+	values = resolvePath(data, segments)
+	return values, len(values) > 0
+}
+
+func resolvePath(value interface{}, segments []pathSegment) []interface{} {
+	if len(segments) == 0 {
+		return []interface{}{value}
+	}
+	segment, rest := segments[0], segments[1:]
+
+	if !segment.isIndex {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v, ok := object[segment.key]
+		if !ok {
+			return nil
+		}
+		return resolvePath(v, rest)
+	}
+
+	array, ok := value.([]interface{})
+	if !ok {
+		return nil
+	}
+	if !segment.wildcard {
+		if segment.index >= len(array) {
+			return nil
+		}
+		return resolvePath(array[segment.index], rest)
+	}
+
+	values := []interface{}{}
+	for _, item := range array {
+		values = append(values, resolvePath(item, rest)...)
+	}
+	return values
+}
+
+// dig returns the value at path in data for templates, like
+// {{ dig "order.items[0].sku" . }}. A path with a wildcard returns all
+// values, a missing path returns nil.
+func dig(path string, data interface{}) interface{} {
+	object, ok := data.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+
+	values, found := lookupPath(object, path)
+	if !found {
+		return nil
+	}
+	if strings.Contains(path, "[*]") {
+		return values
+	}
+	return values[0]
+}
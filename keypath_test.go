@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var nested = map[string]interface{}{}
+
+func init() {
+	json.Unmarshal([]byte(`{
+		"user": {"company": {"plan": "pro"}},
+		"order": {"items": [{"sku": "A1", "price": 50}, {"sku": "B2", "price": 150}]},
+		"matrix": [[1, 2], [3, 4]],
+		"dotted.key": "literal"
+	}`), &nested)
+}
+
+func TestParseKeyPath(t *testing.T) {
+	segments, err := parseKeyPath("order.items[0].sku")
+	assert.Nil(t, err)
+	assert.Equal(t, []pathSegment{{key: "order"}, {key: "items"}, {isIndex: true, index: 0}, {key: "sku"}}, segments)
+
+	segments, err = parseKeyPath("matrix[*][1]")
+	assert.Nil(t, err)
+	assert.Equal(t, []pathSegment{{key: "matrix"}, {isIndex: true, wildcard: true}, {isIndex: true, index: 1}}, segments)
+
+	for _, path := range []string{"", "order..items", ".order", "items[", "items[a]", "items[-1]", "items]0[", "[0]"} {
+		_, err := parseKeyPath(path)
+		assert.NotNil(t, err, path)
+	}
+}
+
+func TestLookupPath(t *testing.T) {
+	values, found := lookupPath(nested, "user.company.plan")
+	assert.True(t, found)
+	assert.Equal(t, []interface{}{"pro"}, values)
+
+	values, found = lookupPath(nested, "order.items[1].sku")
+	assert.True(t, found)
+	assert.Equal(t, []interface{}{"B2"}, values)
+
+	values, found = lookupPath(nested, "order.items[*].price")
+	assert.True(t, found)
+	assert.Equal(t, []interface{}{float64(50), float64(150)}, values)
+
+	values, found = lookupPath(nested, "matrix[*][1]")
+	assert.True(t, found)
+	assert.Equal(t, []interface{}{float64(2), float64(4)}, values)
+
+	values, found = lookupPath(nested, "dotted.key")
+	assert.True(t, found)
+	assert.Equal(t, []interface{}{"literal"}, values)
+
+	for _, path := range []string{"user.name", "order.items[2].sku", "user.company[0]", "order.items.sku"} {
+		_, found := lookupPath(nested, path)
+		assert.False(t, found, path)
+	}
+}
+
+func TestDig(t *testing.T) {
+	assert.Equal(t, "pro", dig("user.company.plan", nested))
+	assert.Equal(t, []interface{}{"A1", "B2"}, dig("order.items[*].sku", nested))
+	assert.Nil(t, dig("user.name", nested))
+	assert.Nil(t, dig("user", "not a map"))
+}
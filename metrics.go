@@ -0,0 +1,160 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// otherLabel replaces label values once a labelLimiter is full
+const otherLabel = "other"
+
+// labelLimiter bounds the amount of distinct label values we export, so
+// senders using many different identifiers can not blow up our metrics
+type labelLimiter struct {
+	mu   sync.Mutex
+	max  int
+	seen map[string]bool
+}
+
+func newLabelLimiter(max int) *labelLimiter {
+	return &labelLimiter{
+		max:  max,
+		seen: map[string]bool{},
+	}
+}
+
+// allow returns true when key was seen before or there is still room for it
+func (l *labelLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.seen[key] {
+		return true
+	}
+	if len(l.seen) >= l.max {
+		return false
+	}
+	l.seen[key] = true
+	return true
+}
+
+// value returns v when it is allowed, or otherLabel when it is not
+func (l *labelLimiter) value(v string) string {
+	if l.allow(v) {
+		return v
+	}
+	return otherLabel
+}
+
+// Limiters for the label values that come from events and notifiers
+var (
+	eventLabels        = newLabelLimiter(200)
+	notifierLabels     = newLabelLimiter(200)
+	notificationLabels = newLabelLimiter(20)
+)
+
+var (
+	eventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_events_received_total",
+		Help: "Events received, per application and identifier.",
+	}, []string{"application", "identifier"})
+
+	eventsRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_events_rejected_total",
+		Help: "Events that were dropped, rejected or failed to process, per reason.",
+	}, []string{"reason"})
+
+	rulesEvaluated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_rules_evaluated_total",
+		Help: "Times the rules of a notifier were checked against an event.",
+	}, []string{"notifier"})
+
+	rulesMatched = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_rules_matched_total",
+		Help: "Times all rules of a notifier were met by an event.",
+	}, []string{"notifier"})
+
+	notificationsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_notifications_sent_total",
+		Help: "Notifications sent, per notification type.",
+	}, []string{"notification_type"})
+
+	notificationsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_notifications_failed_total",
+		Help: "Notifications that could not be sent, per notification type.",
+	}, []string{"notification_type"})
+
+	notificationsSuppressed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notifilter_notifications_suppressed_total",
+		Help: "Notifications suppressed by rate limits or deduplication, per notification type.",
+	}, []string{"notification_type"})
+
+	persistDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "notifilter_persist_duration_seconds",
+		Help:    "Time it took to persist an event to Elasticsearch.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	renderDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "notifilter_template_render_duration_seconds",
+		Help:    "Time it took to render a notification template.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+	})
+)
+
+// setMetricsLabelLimit resets our limiters to allow max values per label
+func setMetricsLabelLimit(max int) {
+	eventLabels = newLabelLimiter(max)
+	notifierLabels = newLabelLimiter(max)
+}
+
+func observeEventReceived(e *Event) {
+	if eventLabels.allow(e.Application + "\x00" + e.Identifier) {
+		eventsReceived.WithLabelValues(e.Application, e.Identifier).Inc()
+		return
+	}
+	eventsReceived.WithLabelValues(otherLabel, otherLabel).Inc()
+}
+
+func observeRules(n *Notifier, matched bool) {
+	id := notifierLabels.value(strconv.Itoa(n.ID))
+	rulesEvaluated.WithLabelValues(id).Inc()
+	if matched {
+		rulesMatched.WithLabelValues(id).Inc()
+	}
+}
+
+func observeNotification(notificationType string, err error) {
+	nt := notificationLabels.value(notificationType)
+	if err != nil {
+		notificationsFailed.WithLabelValues(nt).Inc()
+		return
+	}
+	notificationsSent.WithLabelValues(nt).Inc()
+}
+
+func observeSuppressed(notificationType string) {
+	notificationsSuppressed.WithLabelValues(notificationLabels.value(notificationType)).Inc()
+}
+
+// registerPipelineMetrics exports the queue depth and busy workers of every
+// pool in the pipeline
+func registerPipelineMetrics(p *pipeline) {
+	for i, ps := range p.stats() {
+		i := i
+		labels := prometheus.Labels{"pool": ps.Name}
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "notifilter_queue_depth",
+			Help:        "Events waiting in a queue of the pipeline.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(p.stats()[i].QueueDepth) }))
+		prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        "notifilter_busy_workers",
+			Help:        "Workers of a pool that are processing an event.",
+			ConstLabels: labels,
+		}, func() float64 { return float64(p.stats()[i].BusyWorkers) }))
+	}
+}
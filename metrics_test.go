@@ -0,0 +1,16 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLabelLimiter(t *testing.T) {
+	l := newLabelLimiter(2)
+
+	assert.Equal(t, "a", l.value("a"))
+	assert.Equal(t, "b", l.value("b"))
+	assert.Equal(t, otherLabel, l.value("c"))
+	assert.Equal(t, "a", l.value("a"))
+}
@@ -1,60 +1,164 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"math/rand"
 	"reflect"
 	"text/template"
+	"time"
 
 	"github.com/bittersweet/notifilter-receive/notifiers"
 
 	"github.com/jmoiron/sqlx/types"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
+// defaultNotifyTimeout is used when no NotifyTimeout has been configured
+const defaultNotifyTimeout = 10 * time.Second
+
+// maxRetries is the most max_retries a notifier can have, with the default
+// RetryMaxDelay that is already hours of retrying a single event
+const maxRetries = 100
+
 // Notifier is a db-backed struct that contains everything that is necessary to
 // check incoming events (rules) and what to do when those rules are matched.
 type Notifier struct {
-	ID               int            `db:"id"`
-	Application      string         `db:"application"`
-	EventName        string         `db:"event_name"`
-	Template         string         `db:"template"`
-	Rules            types.JSONText `db:"rules"`
-	NotificationType string         `db:"notification_type"`
-	Target           string         `db:"target"`
+	ID               int            `db:"id" json:"id"`
+	Application      string         `db:"application" json:"application"`
+	EventName        string         `db:"event_name" json:"event_name"`
+	Template         string         `db:"template" json:"template"`
+	Rules            types.JSONText `db:"rules" json:"rules"`
+	NotificationType string         `db:"notification_type" json:"notification_type"`
+	Target           string         `db:"target" json:"target"`
+	MaxRetries       int            `db:"max_retries" json:"max_retries"`
+	// Source is "file" for notifiers synced from NotifierDir, FileKey is the
+	// key they have in their file
+	Source  string `db:"source" json:"source"`
+	FileKey string `db:"file_key" json:"file_key"`
+
+	// A notifier is only checked when it is enabled, not snoozed and inside
+	// one of the windows of its Schedule (when it has any)
+	Enabled      bool           `db:"enabled" json:"enabled"`
+	SnoozedUntil *time.Time     `db:"snoozed_until" json:"snoozed_until"`
+	Schedule     types.JSONText `db:"schedule" json:"schedule"`
+
+	// Throttle limits how often messages are sent, see throttleSettings
+	Throttle types.JSONText `db:"throttle" json:"throttle"`
+
+	// Parsed versions of Rules, Template, Schedule and Throttle, set by
+	// prepare
+	rules       *ruleTree
+	rulesErr    error
+	template    *template.Template
+	templateErr error
+	schedule    []*scheduleWindow
+	throttle    *throttleSettings
+	throttleErr error
 }
 
-func (n *Notifier) newNotifier() notifiers.MessageNotifier {
-	switch n.NotificationType {
-	case "email":
+// notificationChannels creates the MessageNotifier for every notification
+// type we support
+var notificationChannels = map[string]func() notifiers.MessageNotifier{
+	"email": func() notifiers.MessageNotifier {
 		return &notifiers.EmailNotifier{}
-	case "slack":
+	},
+	"slack": func() notifiers.MessageNotifier {
 		return &notifiers.SlackNotifier{
 			HookURL: C.SlackHookURL,
 		}
+	},
+}
+
+func (n *Notifier) newNotifier() notifiers.MessageNotifier {
+	if channel, ok := notificationChannels[n.NotificationType]; ok {
+		return channel()
 	}
 	return &notifiers.SlackNotifier{
 		HookURL: C.SlackHookURL,
 	}
 }
 
-func (n *Notifier) getRules() []*rule {
-	rules := []*rule{}
-	n.Rules.Unmarshal(&rules)
-	return rules
+// validate checks a notifier before it is written, so it will not fail on
+// every event instead
+func (n *Notifier) validate() error {
+	errs := []error{}
+	if n.Application == "" {
+		errs = append(errs, errors.New("application is required"))
+	}
+	if n.EventName == "" {
+		errs = append(errs, errors.New("event_name is required"))
+	}
+	if _, ok := notificationChannels[n.NotificationType]; !ok {
+		errs = append(errs, fmt.Errorf("unknown notification_type %q", n.NotificationType))
+	}
+	if n.MaxRetries < 0 {
+		errs = append(errs, errors.New("max_retries can not be negative"))
+	}
+	if n.MaxRetries > maxRetries {
+		errs = append(errs, fmt.Errorf("max_retries can not be more than %d", maxRetries))
+	}
+	_, err := parseTemplate(n.Template)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid template: %s", err))
+	}
+	_, err = parseRules(n.Rules)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid rules: %s", err))
+	}
+	_, err = parseSchedule(n.Schedule)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid schedule: %s", err))
+	}
+	_, err = parseThrottle(n.Throttle)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid throttle: %s", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (n *Notifier) getThrottle() (*throttleSettings, error) {
+	if n.throttle != nil || n.throttleErr != nil {
+		return n.throttle, n.throttleErr
+	}
+	return parseThrottle(n.Throttle)
+}
+
+// getRules returns the rules set by prepare, or parses them when the
+// notifier was not prepared
+func (n *Notifier) getRules() (*ruleTree, error) {
+	if n.rules != nil || n.rulesErr != nil {
+		return n.rules, n.rulesErr
+	}
+	return loadRules(n.Rules)
 }
 
 func (n *Notifier) checkRules(e *Event) bool {
-	rules := n.getRules()
-	for _, rule := range rules {
-		if !rule.Met(e) {
-			e.log("[NOTIFY] rule not met -- Key: %s, Type: %s, Setting %s, Value %s, Received Value %v", rule.Key, rule.Type, rule.Setting, rule.Value, e.dataToMap()[rule.Key])
-			e.log("[NOTIFY] Stopping notification of id: %d, rules not met", n.ID)
-			return false
-		}
+	met, _, err := n.evaluateRules(e)
+	if err != nil {
+		e.log("[NOTIFY] Could not check rules of id: %d: %s", n.ID, err)
 	}
+	return met
+}
 
-	return true
+// evaluateRules returns whether the rules are met and if not, the branch that
+// failed. It returns an error when they could not be checked against the
+// event.
+func (n *Notifier) evaluateRules(e *Event) (bool, string, error) {
+	tree, err := n.getRules()
+	if err != nil {
+		return false, "", fmt.Errorf("invalid rules: %s", err)
+	}
+	met, failed, err := tree.evaluate(e)
+	if err != nil || met {
+		return met, failed, err
+	}
+
+	e.log("[NOTIFY] rules not met -- %s", failed)
+	e.log("[NOTIFY] Stopping notification of id: %d, rules not met", n.ID)
+	return false, failed, nil
 }
 
 func isset(a map[string]interface{}, key string) bool {
@@ -78,13 +182,13 @@ func present(str interface{}) bool {
 	return true
 }
 
-func decodeJSON(str string) map[string]interface{} {
+func decodeJSON(str string) (map[string]interface{}, error) {
 	var parsed map[string]interface{}
 	err := json.Unmarshal([]byte(str), &parsed)
 	if err != nil {
-		log.Fatal("json.Unmarshal decodeJson", err)
+		return nil, fmt.Errorf("decodeJSON: %s", err)
 	}
-	return parsed
+	return parsed, nil
 }
 
 func eq(x, y interface{}) bool {
@@ -111,58 +215,168 @@ var funcMap = template.FuncMap{
 	"present":    present,
 	"eq":         eq,
 	"decodeJSON": decodeJSON,
+	"dig":        dig,
 }
 
 func (n *Notifier) renderTemplate(e *Event) ([]byte, error) {
-	var err error
-	var doc bytes.Buffer
+	timer := prometheus.NewTimer(renderDuration)
+	defer timer.ObserveDuration()
 
-	t := template.New("notificationTemplate")
-	t.Funcs(funcMap)
-	t, err = t.Parse(n.Template)
-	if err != nil {
-		return []byte(""), err
+	t, err := n.template, n.templateErr
+	if t == nil && err == nil {
+		t, err = parseTemplate(n.Template)
 	}
-
-	err = t.Execute(&doc, e.dataToMap())
 	if err != nil {
 		return []byte(""), err
 	}
 
-	return doc.Bytes(), nil
+	return executeTemplate(t, e)
 }
 
-func (n *Notifier) notify(e *Event, mn notifiers.MessageNotifier) {
+// notify sends a notification when the rules are met by the event, and
+// records the outcome in the delivery log
+func (n *Notifier) notify(ctx context.Context, e *Event, mn notifiers.MessageNotifier) error {
+	d, err := n.evaluate(ctx, e, mn)
+	saveDelivery(d)
+	return err
+}
+
+// evaluate checks the rules and sends the notification when they are met. A
+// panic while doing so is recovered and returned as an error, so one broken
+// notifier can not take down the others.
+func (n *Notifier) evaluate(ctx context.Context, e *Event, mn notifiers.MessageNotifier) (d delivery, err error) {
 	nt := n.NotificationType
 	e.log("[NOTIFY] Notifying notifier id: %d type: %s", n.ID, nt)
 
-	if !n.checkRules(e) {
-		return
+	d = delivery{
+		RequestID:  e.requestID,
+		NotifierID: n.ID,
+		Channel:    nt,
+		Target:     n.Target,
+		CreatedAt:  time.Now(),
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+		if err != nil {
+			e.log("[NOTIFY] Notifying notifier id: %d failed: %s", n.ID, err)
+			observeNotification(nt, err)
+			d.Error = err.Error()
+			if d.Status == "" {
+				d.Status = deliveryError
+			}
+		}
+		d.FinishedAt = time.Now()
+	}()
+
+	matched, failed, err := n.evaluateRules(e)
+	if err != nil {
+		return d, err
+	}
+	observeRules(n, matched)
+	d.Matched = matched
+	if !matched {
+		d.Status = deliveryNotMatched
+		d.FailedRule = failed
+		return d, nil
 	}
 
 	message, err := n.renderTemplate(e)
 	if err != nil {
-		e.log("[NOTIFY] renderTemplate failed:", err)
+		return d, fmt.Errorf("renderTemplate failed: %s", err)
+	}
+
+	ts, err := n.getThrottle()
+	if err != nil {
+		return d, fmt.Errorf("invalid throttle: %s", err)
+	}
+	key, err := ts.dedupKey(e)
+	if err != nil {
+		return d, fmt.Errorf("dedup key failed: %s", err)
 	}
-	mn.SendMessage(n.Target, n.EventName, message)
-	e.log("[NOTIFY] Notifying notifier id: %d done", n.ID)
+	admitted := time.Now()
+	allowed, suppressed, reason := throttles.admit(n.ID, ts, key, admitted)
+	if !allowed {
+		e.log("[NOTIFY] Suppressing notifier id: %d, %s", n.ID, reason)
+		observeSuppressed(nt)
+		d.Status = deliverySuppressed
+		d.Message = string(message)
+		d.Error = reason
+		return d, nil
+	}
+	if suppressed > 0 {
+		message = append(message, suppressedNote(suppressed)...)
+	}
+	d.Message = string(message)
+
+	res, attempts := n.deliver(ctx, e, mn, message)
+	d.Attempts = attempts
+	d.Response = res.Response
+	if res.Err != nil {
+		throttles.release(n.ID, ts, key, admitted, suppressed)
+		d.Status = deliveryFailed
+		saveDeadLetter(newDeadLetter(n, e, message, res, attempts))
+		return d, res.Err
+	}
+	d.Status = deliveryDelivered
+	observeNotification(nt, nil)
+	e.log("[NOTIFY] Notifying notifier id: %d done in %s", n.ID, res.Latency)
+	return d, nil
 }
 
-func renderTemplate(tmpl string, e *Event) ([]byte, error) {
-	var err error
-	var doc bytes.Buffer
+// deliver sends the message, retrying retryable failures up to MaxRetries
+// times with a jittered exponential backoff. It returns the last result and
+// the amount of attempts it took. Once ctx is done it stops retrying, so the
+// caller saves a dead letter instead.
+func (n *Notifier) deliver(ctx context.Context, e *Event, mn notifiers.MessageNotifier, message []byte) (notifiers.DeliveryResult, int) {
+	var res notifiers.DeliveryResult
+	attempt := 0
+	for {
+		attempt++
+		attemptCtx, cancel := context.WithTimeout(ctx, notifyTimeout())
+		res = mn.SendMessage(attemptCtx, n.Target, n.EventName, message)
+		cancel()
+		if res.Err == nil {
+			return res, attempt
+		}
 
-	t := template.New("notificationTemplate")
-	t.Funcs(funcMap)
-	t, err = t.Parse(tmpl)
-	if err != nil {
-		return []byte(""), err
+		e.log("[NOTIFY] Delivery %d to %s failed after %s, retryable: %t, response: %s", attempt, n.Target, res.Latency, res.Retryable, res.Response)
+		if !res.Retryable || attempt > n.MaxRetries {
+			return res, attempt
+		}
+		select {
+		case <-time.After(backoff(attempt, C.RetryBaseDelay, C.RetryMaxDelay)):
+		case <-ctx.Done():
+			e.log("[NOTIFY] Stopped retrying notifier id: %d: %s", n.ID, ctx.Err())
+			return res, attempt
+		}
 	}
+}
 
-	err = t.Execute(&doc, e.dataToMap())
-	if err != nil {
-		return []byte(""), err
+// backoff returns how long to wait before retrying for the given attempt. It
+// is a random duration up to a maximum that doubles with every attempt, so
+// notifiers that failed at the same time do not all retry at once.
+func backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	if base <= 0 || max <= 0 {
+		return 0
+	}
+
+	// Stop doubling before d passes max, so a large base can not overflow
+	d := base
+	for i := 1; i < attempt && d <= max/2; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
 	}
+	return time.Duration(rand.Int63n(int64(d))) + 1
+}
 
-	return doc.Bytes(), nil
+// notifyTimeout is how long we wait for a single delivery
+func notifyTimeout() time.Duration {
+	if C.NotifyTimeout > 0 {
+		return C.NotifyTimeout
+	}
+	return defaultNotifyTimeout
 }
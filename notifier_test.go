@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/bittersweet/notifilter-receive/notifiers"
 	"github.com/jmoiron/sqlx/types"
@@ -15,11 +19,12 @@ type LocalMessageNotifier struct {
 	Processed bool
 }
 
-func (mn *LocalMessageNotifier) SendMessage(target string, eventName string, data []byte) {
+func (mn *LocalMessageNotifier) SendMessage(ctx context.Context, target string, eventName string, data []byte) notifiers.DeliveryResult {
 	mn.Target = target
 	mn.EventName = eventName
 	mn.Message = data
 	mn.Processed = true
+	return notifiers.DeliveryResult{}
 }
 
 func setupTestNotifier(data types.JSONText) Event {
@@ -86,7 +91,7 @@ func TestNotifierCheckRulesMultiple(t *testing.T) {
 }
 
 func TestNotifierCheckRulesSettingIsNull(t *testing.T) {
-	var rules = types.JSONText(`[{"key": "name", "type": "string", "setting": null "value": "Go"}]`)
+	var rules = types.JSONText(`[{"key": "name", "type": "string", "setting": null, "value": "Go"}]`)
 	n := Notifier{
 		NotificationType: "email",
 		EventName:        "User",
@@ -127,7 +132,7 @@ func TestNotifierNotify(t *testing.T) {
 	event := setupTestNotifier(data)
 
 	mn := &LocalMessageNotifier{}
-	n.notify(&event, mn)
+	n.notify(context.Background(), &event, mn)
 
 	assert.Equal(t, "signup", mn.EventName)
 	assert.Equal(t, []byte("name: Go"), mn.Message)
@@ -147,11 +152,44 @@ func TestNotifierNotifyReturnsEarlyIfRulesAreNotMet(t *testing.T) {
 	event := setupTestNotifier(data)
 
 	mn := &LocalMessageNotifier{}
-	n.notify(&event, mn)
+	n.notify(context.Background(), &event, mn)
 
 	assert.Equal(t, false, mn.Processed)
 }
 
+func TestNotifierNotifyDoesNotSendOnInvalidRules(t *testing.T) {
+	n := Notifier{
+		ID:               1,
+		EventName:        "User",
+		Template:         "plan: {{.plan}}",
+		Rules:            types.JSONText(`{"any": [{"key": "plan", "type": "string", "setting": "eq", "value": "enterprise", "id": 3}]}`),
+		NotificationType: "email",
+	}
+	n.prepare()
+	assert.NotNil(t, n.rulesErr)
+
+	event := setupTestNotifier(types.JSONText(`{"plan": "free"}`))
+	mn := &LocalMessageNotifier{}
+	d, err := n.evaluate(context.Background(), &event, mn)
+
+	assert.NotNil(t, err)
+	assert.Equal(t, deliveryError, d.Status)
+	assert.Equal(t, false, mn.Processed)
+}
+
+func TestNotifierLoadsLegacyRuleListsLeniently(t *testing.T) {
+	n := Notifier{
+		Rules: types.JSONText(`[{"key": "plan", "type": "string", "setting": "eq", "value": "enterprise", "id": 3}]`),
+	}
+	n.prepare()
+	assert.Nil(t, n.rulesErr)
+
+	event := setupTestNotifier(types.JSONText(`{"plan": "free"}`))
+	assert.Equal(t, false, n.checkRules(&event))
+	event = setupTestNotifier(types.JSONText(`{"plan": "enterprise"}`))
+	assert.Equal(t, true, n.checkRules(&event))
+}
+
 func TestNotifierRenderTemplate(t *testing.T) {
 	n := Notifier{
 		EventName:        "User",
@@ -289,3 +327,258 @@ func TestDecodeJSON(t *testing.T) {
 	expected := []byte("nested: value")
 	assert.Equal(t, expected, result)
 }
+
+type FailingMessageNotifier struct{}
+
+func (mn *FailingMessageNotifier) SendMessage(ctx context.Context, target string, eventName string, data []byte) notifiers.DeliveryResult {
+	return notifiers.DeliveryResult{Err: errors.New("connection refused"), Retryable: true}
+}
+
+type PanickingMessageNotifier struct{}
+
+func (mn *PanickingMessageNotifier) SendMessage(ctx context.Context, target string, eventName string, data []byte) notifiers.DeliveryResult {
+	panic("boom")
+}
+
+func TestNotifierNotifyReturnsSendError(t *testing.T) {
+	n := Notifier{
+		EventName: "signup",
+		Template:  "name: {{.name}}",
+	}
+
+	data := types.JSONText(`{"name": "Go"}`)
+	event := setupTestNotifier(data)
+
+	err := n.notify(context.Background(), &event, &FailingMessageNotifier{})
+	assert.Equal(t, "connection refused", err.Error())
+}
+
+func TestNotifierNotifyRecoversPanic(t *testing.T) {
+	n := Notifier{
+		EventName: "signup",
+		Template:  "name: {{.name}}",
+	}
+
+	data := types.JSONText(`{"name": "Go"}`)
+	event := setupTestNotifier(data)
+
+	err := n.notify(context.Background(), &event, &PanickingMessageNotifier{})
+	assert.Equal(t, "panic: boom", err.Error())
+}
+
+func TestNotifierNotifyDoesNotSendOnTemplateError(t *testing.T) {
+	n := Notifier{
+		Template: "nested: {{ $obj := decodeJSON .nested }}{{ $obj.key }}",
+	}
+
+	data := types.JSONText(`{"nested": "not json"}`)
+	event := setupTestNotifier(data)
+
+	mn := &LocalMessageNotifier{}
+	err := n.notify(context.Background(), &event, mn)
+	assert.NotNil(t, err)
+	assert.Equal(t, false, mn.Processed)
+}
+
+type FlakyMessageNotifier struct {
+	Failures int
+	Attempts int
+}
+
+func (mn *FlakyMessageNotifier) SendMessage(ctx context.Context, target string, eventName string, data []byte) notifiers.DeliveryResult {
+	mn.Attempts++
+	if mn.Attempts <= mn.Failures {
+		return notifiers.DeliveryResult{Err: errors.New("503"), Retryable: true}
+	}
+	return notifiers.DeliveryResult{}
+}
+
+func TestNotifierNotifyRetries(t *testing.T) {
+	n := Notifier{
+		Template:   "name: {{.name}}",
+		MaxRetries: 2,
+	}
+
+	data := types.JSONText(`{"name": "Go"}`)
+	event := setupTestNotifier(data)
+
+	mn := &FlakyMessageNotifier{Failures: 2}
+	err := n.notify(context.Background(), &event, mn)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, mn.Attempts)
+}
+
+func TestNotifierNotifyGivesUpAfterMaxRetries(t *testing.T) {
+	n := Notifier{
+		Template:   "name: {{.name}}",
+		MaxRetries: 1,
+	}
+
+	data := types.JSONText(`{"name": "Go"}`)
+	event := setupTestNotifier(data)
+
+	mn := &FlakyMessageNotifier{Failures: 5}
+	err := n.notify(context.Background(), &event, mn)
+	assert.NotNil(t, err)
+	assert.Equal(t, 2, mn.Attempts)
+}
+
+func TestNotifierStopsRetryingWhenCanceled(t *testing.T) {
+	defer func(base, max time.Duration) { C.RetryBaseDelay, C.RetryMaxDelay = base, max }(C.RetryBaseDelay, C.RetryMaxDelay)
+	C.RetryBaseDelay, C.RetryMaxDelay = time.Hour, time.Hour
+
+	n := Notifier{
+		Template:   "name: {{.name}}",
+		MaxRetries: 10,
+	}
+	event := setupTestNotifier(types.JSONText(`{"name": "Go"}`))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	mn := &FlakyMessageNotifier{Failures: 100}
+	d, err := n.evaluate(ctx, &event, mn)
+	assert.NotNil(t, err)
+	assert.Equal(t, deliveryFailed, d.Status)
+	assert.Equal(t, 1, mn.Attempts)
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 1; attempt < 40; attempt++ {
+		d := backoff(attempt, 100*time.Millisecond, time.Second)
+		assert.True(t, d > 0)
+		assert.True(t, d <= time.Second)
+	}
+	assert.True(t, backoff(1, 100*time.Millisecond, time.Second) <= 100*time.Millisecond)
+	assert.Equal(t, time.Duration(0), backoff(1, 0, 0))
+
+	// A large base reaches max without overflowing
+	large := time.Duration(math.MaxInt64 / 4)
+	for attempt := 1; attempt < 40; attempt++ {
+		d := backoff(attempt, large, time.Duration(math.MaxInt64))
+		assert.True(t, d > 0)
+	}
+	assert.True(t, backoff(3, time.Hour, time.Minute) <= time.Minute)
+}
+
+func TestNotifierValidateMaxRetries(t *testing.T) {
+	n := Notifier{Application: "app", EventName: "signup", NotificationType: "slack", MaxRetries: maxRetries}
+	assert.Nil(t, n.validate())
+
+	n.MaxRetries = maxRetries + 1
+	assert.Contains(t, n.validate().Error(), "max_retries can not be more than")
+}
+
+func TestNotifierEvaluateDelivered(t *testing.T) {
+	n := Notifier{
+		ID:               42,
+		Template:         "name: {{.name}}",
+		NotificationType: "slack",
+		Target:           "#general",
+	}
+
+	data := types.JSONText(`{"name": "Go"}`)
+	event := setupTestNotifier(data)
+	event.requestID = "abc"
+
+	d, err := n.evaluate(context.Background(), &event, &LocalMessageNotifier{})
+	assert.Nil(t, err)
+	assert.Equal(t, deliveryDelivered, d.Status)
+	assert.Equal(t, "abc", d.RequestID)
+	assert.Equal(t, 42, d.NotifierID)
+	assert.Equal(t, "name: Go", d.Message)
+	assert.Equal(t, "#general", d.Target)
+	assert.Equal(t, 1, d.Attempts)
+	assert.True(t, d.Matched)
+}
+
+func TestNotifierEvaluateNotMatched(t *testing.T) {
+	n := Notifier{
+		Template: "name: {{.name}}",
+		Rules:    types.JSONText(`[{"key": "number", "type": "number", "setting": "gt", "value": "1"}]`),
+	}
+
+	data := types.JSONText(`{"number": 0}`)
+	event := setupTestNotifier(data)
+
+	d, err := n.evaluate(context.Background(), &event, &LocalMessageNotifier{})
+	assert.Nil(t, err)
+	assert.Equal(t, deliveryNotMatched, d.Status)
+	assert.Equal(t, `number number gt "1"`, d.FailedRule)
+	assert.False(t, d.Matched)
+}
+
+func TestNotifierEvaluateFailed(t *testing.T) {
+	n := Notifier{
+		Template: "name: {{.name}}",
+	}
+
+	data := types.JSONText(`{"name": "Go"}`)
+	event := setupTestNotifier(data)
+
+	d, err := n.evaluate(context.Background(), &event, &FailingMessageNotifier{})
+	assert.NotNil(t, err)
+	assert.Equal(t, deliveryFailed, d.Status)
+	assert.Equal(t, "connection refused", d.Error)
+}
+
+func TestEventNotifyWithMemoryStore(t *testing.T) {
+	mn := &LocalMessageNotifier{}
+	notificationChannels["local"] = func() notifiers.MessageNotifier { return mn }
+	defer delete(notificationChannels, "local")
+
+	store := newMemoryNotifierStore()
+	store.Create(&Notifier{Application: "app", EventName: "signup", Template: "{{ .name }} signed up", Rules: types.JSONText(`[{"key": "active", "type": "boolean", "value": "true"}]`), NotificationType: "local", Target: "#signups", Enabled: true})
+	store.Create(&Notifier{Application: "app", EventName: "order", Template: "order", NotificationType: "local", Enabled: true})
+
+	defer func(s *notifierCache) { notifierSnapshot = s }(notifierSnapshot)
+	notifierSnapshot = newNotifierCache(store.List)
+	assert.Nil(t, notifierSnapshot.reload())
+
+	event := Event{Application: "app", Identifier: "signup", Data: types.JSONText(`{"active": true, "name": "Go"}`)}
+	assert.Nil(t, event.notify(context.Background()))
+	assert.Equal(t, true, mn.Processed)
+	assert.Equal(t, "#signups", mn.Target)
+	assert.Equal(t, "Go signed up", string(mn.Message))
+}
+
+func TestEventNotifySkipsPausedNotifiers(t *testing.T) {
+	mn := &LocalMessageNotifier{}
+	notificationChannels["local"] = func() notifiers.MessageNotifier { return mn }
+	defer delete(notificationChannels, "local")
+
+	until := time.Now().Add(time.Hour)
+	store := newMemoryNotifierStore()
+	store.Create(&Notifier{Application: "app", EventName: "signup", NotificationType: "local", Enabled: false})
+	store.Create(&Notifier{Application: "app", EventName: "signup", NotificationType: "local", Enabled: true, SnoozedUntil: &until})
+
+	defer func(s *notifierCache) { notifierSnapshot = s }(notifierSnapshot)
+	notifierSnapshot = newNotifierCache(store.List)
+	assert.Nil(t, notifierSnapshot.reload())
+
+	event := Event{Application: "app", Identifier: "signup", Data: types.JSONText(`{}`)}
+	assert.Nil(t, event.notify(context.Background()))
+	assert.Equal(t, false, mn.Processed)
+}
+
+func TestNotifierRenderWithDig(t *testing.T) {
+	n := Notifier{Template: `{{ dig "order.items[1].sku" . }} {{ range dig "order.items[*].price" . }}{{ . }} {{ end }}`}
+	event := setupTestNotifier(types.JSONText(`{"order": {"items": [{"sku": "A1", "price": 50}, {"sku": "B2", "price": 150}]}}`))
+
+	result, err := n.renderTemplate(&event)
+	assert.Nil(t, err)
+	assert.Equal(t, "B2 50 150 ", string(result))
+}
+
+func TestNotifierDeliveryShowsTypeMismatch(t *testing.T) {
+	n := Notifier{
+		ID:       1,
+		Template: "{{ .revenue }}",
+		Rules:    types.JSONText(`[{"key": "revenue", "type": "number", "setting": "gt", "value": "100"}]`),
+	}
+	event := setupTestNotifier(types.JSONText(`{"revenue": "lots"}`))
+
+	d, err := n.evaluate(context.Background(), &event, &LocalMessageNotifier{})
+	assert.Nil(t, err)
+	assert.Equal(t, deliveryNotMatched, d.Status)
+	assert.Equal(t, `revenue number gt "100" (expected a number, got string "lots")`, d.FailedRule)
+}
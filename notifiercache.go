@@ -0,0 +1,139 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// notifierKey indexes notifiers by the events they are interested in
+type notifierKey struct {
+	application string
+	eventName   string
+}
+
+// notifierCache holds a snapshot of all notifiers with their rules and
+// templates parsed, so we do not have to query the store for every event.
+// Reloads are started by the API, the store, a ticker and the file watcher,
+// reloading makes them run one at a time so a slow load of older notifiers
+// can not replace a newer snapshot.
+type notifierCache struct {
+	reloading sync.Mutex
+
+	mu       sync.RWMutex
+	byEvent  map[notifierKey][]Notifier
+	loadedAt time.Time
+	load     func() ([]Notifier, error)
+}
+
+// notifierSnapshot is used by the workers to look up notifiers
+var notifierSnapshot *notifierCache
+
+func newNotifierCache(load func() ([]Notifier, error)) *notifierCache {
+	return &notifierCache{
+		byEvent: map[notifierKey][]Notifier{},
+		load:    load,
+	}
+}
+
+// reload replaces the snapshot, when loading fails the previous snapshot is
+// kept
+func (c *notifierCache) reload() error {
+	c.reloading.Lock()
+	defer c.reloading.Unlock()
+
+	notifiers, err := c.load()
+	if err != nil {
+		return err
+	}
+
+	byEvent := map[notifierKey][]Notifier{}
+	ids := map[int]bool{}
+	for _, n := range notifiers {
+		n.prepare()
+		key := notifierKey{n.Application, n.EventName}
+		byEvent[key] = append(byEvent[key], n)
+		ids[n.ID] = true
+	}
+	ruleTrees.retain(ids)
+	templates.retain(ids)
+	throttles.retain(ids)
+
+	c.mu.Lock()
+	c.byEvent = byEvent
+	c.loadedAt = time.Now()
+	c.mu.Unlock()
+
+	log.Printf("[CACHE] loaded %d notifiers\n", len(notifiers))
+	return nil
+}
+
+// lookup returns the notifiers for an event
+func (c *notifierCache) lookup(application string, eventName string) []Notifier {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.byEvent[notifierKey{application, eventName}]
+}
+
+// listen reloads the snapshot whenever the store tells us about a change,
+// and every interval in case we missed one
+func (c *notifierCache) listen(changes <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+		}
+
+		err := c.reload()
+		if err != nil {
+			log.Println("[CACHE] Could not reload notifiers: ", err)
+		}
+	}
+}
+
+// refreshNotifiers reloads the cache right away so our own changes are used
+// for the next event
+func refreshNotifiers() {
+	if notifierSnapshot == nil {
+		return
+	}
+	err := notifierSnapshot.reload()
+	if err != nil {
+		log.Println("[CACHE] Could not reload notifiers: ", err)
+	}
+}
+
+// prepare parses the rules and template once, so they can be reused for
+// every event. Rules or a template that do not parse are reported when they
+// change, the notifier will fail with that error for every event.
+func (n *Notifier) prepare() {
+	cr, fresh := ruleTrees.get(n.ID, n.Rules)
+	n.rules, n.rulesErr = cr.tree, cr.err
+	if n.rulesErr != nil && fresh {
+		log.Printf("[CACHE] rules of notifier id: %d do not parse: %s\n", n.ID, n.rulesErr)
+	}
+
+	schedule, err := parseSchedule(n.Schedule)
+	if err != nil {
+		log.Printf("[CACHE] schedule of notifier id: %d does not parse: %s\n", n.ID, err)
+	}
+	n.schedule = schedule
+
+	n.throttle, n.throttleErr = parseThrottle(n.Throttle)
+	if n.throttleErr != nil {
+		log.Printf("[CACHE] throttle of notifier id: %d does not parse: %s\n", n.ID, n.throttleErr)
+	}
+
+	ct, fresh := templates.get(n.ID, n.Template)
+	n.template, n.templateErr = ct.template, ct.err
+	if n.templateErr != nil && fresh {
+		log.Printf("[CACHE] template of notifier id: %d does not parse: %s\n", n.ID, n.templateErr)
+	}
+}
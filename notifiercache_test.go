@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNotifierCacheLookup(t *testing.T) {
+	c := newNotifierCache(func() ([]Notifier, error) {
+		return []Notifier{
+			{ID: 1, Application: "app", EventName: "signup", Template: "{{ .name }}", Rules: types.JSONText(`[{"key": "name", "type": "string", "value": "Go"}]`)},
+			{ID: 2, Application: "app", EventName: "signup"},
+			{ID: 3, Application: "app", EventName: "conversion"},
+		}, nil
+	})
+	assert.Nil(t, c.reload())
+
+	notifiers := c.lookup("app", "signup")
+	assert.Equal(t, 2, len(notifiers))
+	assert.Equal(t, 1, len(notifiers[0].rules.children))
+	assert.NotNil(t, notifiers[0].template)
+	assert.Equal(t, 0, len(c.lookup("other", "signup")))
+}
+
+func TestNotifierCacheKeepsSnapshotOnError(t *testing.T) {
+	fail := false
+	c := newNotifierCache(func() ([]Notifier, error) {
+		if fail {
+			return nil, errors.New("connection refused")
+		}
+		return []Notifier{{ID: 1, Application: "app", EventName: "signup"}}, nil
+	})
+	assert.Nil(t, c.reload())
+
+	fail = true
+	assert.NotNil(t, c.reload())
+	assert.Equal(t, 1, len(c.lookup("app", "signup")))
+}
+
+func TestNotifierCacheReloadsOneAtATime(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	loading := make(chan struct{})
+	c := newNotifierCache(func() ([]Notifier, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(loading)
+			<-release
+			return []Notifier{{ID: 1, Application: "app", EventName: "signup"}}, nil
+		}
+		return []Notifier{{ID: 1, Application: "app", EventName: "signup"}, {ID: 2, Application: "app", EventName: "signup"}}, nil
+	})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		c.reload()
+	}()
+	<-loading
+	go func() {
+		defer wg.Done()
+		c.reload()
+	}()
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	assert.Equal(t, 2, len(c.lookup("app", "signup")))
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Modes for notifiers defined in NotifierDir
+const (
+	// notifierDirMerge uses the files next to the notifiers in the store
+	notifierDirMerge = "merge"
+	// notifierDirReplace only uses the files, the store is ignored
+	notifierDirReplace = "replace"
+	// notifierDirSync writes the files to the store
+	notifierDirSync = "sync"
+)
+
+// notifierFileSource marks the notifiers in the store that are managed by sync
+const notifierFileSource = "file"
+
+// notifierDefinition describes a notifier in a file
+type notifierDefinition struct {
+	Key              string    `yaml:"key"`
+	Application      string    `yaml:"application"`
+	EventName        string    `yaml:"event_name"`
+	Template         string    `yaml:"template"`
+	Rules            *ruleTree `yaml:"rules"`
+	NotificationType string    `yaml:"notification_type"`
+	Target           string    `yaml:"target"`
+	MaxRetries       *int      `yaml:"max_retries"`
+	Enabled          *bool     `yaml:"enabled"`
+
+	Schedule []scheduleWindow  `yaml:"schedule"`
+	Throttle *throttleSettings `yaml:"throttle"`
+}
+
+// notifierDocument is a single file, it holds one or more notifiers
+type notifierDocument struct {
+	Notifiers []notifierDefinition `yaml:"notifiers"`
+}
+
+// notifierFiles reads notifiers from a directory of YAML and JSON files,
+// store is where they are merged with or synced to
+type notifierFiles struct {
+	dir   string
+	store NotifierStore
+}
+
+func newNotifierFiles(dir string, store NotifierStore) *notifierFiles {
+	return &notifierFiles{dir: dir, store: store}
+}
+
+// paths returns the YAML and JSON files in the directory, sorted by name
+func (nf *notifierFiles) paths() ([]string, error) {
+	entries, err := os.ReadDir(nf.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json":
+			paths = append(paths, filepath.Join(nf.dir, entry.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// load reads and validates all files, a single invalid notifier fails the
+// whole load so we never run with half of the definitions. Notifiers get
+// negative IDs derived from their key, they are not in the store.
+func (nf *notifierFiles) load() ([]Notifier, error) {
+	paths, err := nf.paths()
+	if err != nil {
+		return nil, err
+	}
+
+	notifiers := []Notifier{}
+	seen := map[string]string{}
+	ids := map[int]bool{}
+	for _, path := range paths {
+		defined, err := readNotifierFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		for i, n := range defined {
+			if other, ok := seen[n.FileKey]; ok {
+				return nil, fmt.Errorf("%s: notifier %d has key %q, which is already used in %s", path, i, n.FileKey, other)
+			}
+			seen[n.FileKey] = path
+
+			n.ID = fileID(n.FileKey)
+			for ids[n.ID] {
+				n.ID--
+			}
+			ids[n.ID] = true
+			notifiers = append(notifiers, n)
+		}
+	}
+	return notifiers, nil
+}
+
+// readNotifierFile decodes and validates the notifiers in a single file. YAML
+// is a superset of JSON, so both are read the same way.
+func readNotifierFile(path string) ([]Notifier, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc notifierDocument
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err = decoder.Decode(&doc)
+	if err != nil {
+		return nil, err
+	}
+
+	notifiers := []Notifier{}
+	for i, def := range doc.Notifiers {
+		n, err := def.notifier()
+		if err != nil {
+			return nil, fmt.Errorf("notifier %d: %s", i, err)
+		}
+		notifiers = append(notifiers, n)
+	}
+	return notifiers, nil
+}
+
+func (def notifierDefinition) notifier() (Notifier, error) {
+	if def.Key == "" {
+		return Notifier{}, errors.New("key is required")
+	}
+
+	rules := def.Rules
+	if rules == nil {
+		rules = noRules()
+	}
+	encoded, err := json.Marshal(rules)
+	if err != nil {
+		return Notifier{}, err
+	}
+
+	schedule := def.Schedule
+	if schedule == nil {
+		schedule = []scheduleWindow{}
+	}
+	encodedSchedule, err := json.Marshal(schedule)
+	if err != nil {
+		return Notifier{}, err
+	}
+
+	throttle := def.Throttle
+	if throttle == nil {
+		throttle = &throttleSettings{}
+	}
+	encodedThrottle, err := json.Marshal(throttle)
+	if err != nil {
+		return Notifier{}, err
+	}
+
+	n := Notifier{
+		Application:      def.Application,
+		EventName:        def.EventName,
+		Template:         def.Template,
+		Rules:            types.JSONText(encoded),
+		NotificationType: def.NotificationType,
+		Target:           def.Target,
+		MaxRetries:       3,
+		Source:           notifierFileSource,
+		FileKey:          def.Key,
+		Enabled:          true,
+		Schedule:         types.JSONText(encodedSchedule),
+		Throttle:         types.JSONText(encodedThrottle),
+	}
+	if def.MaxRetries != nil {
+		n.MaxRetries = *def.MaxRetries
+	}
+	if def.Enabled != nil {
+		n.Enabled = *def.Enabled
+	}
+	return n, n.validate()
+}
+
+// fileID derives a negative ID from the key of a notifier in a file, so its
+// throttle and delivery log stay the same when files are added or reordered
+// and when the notifier itself changes
+func fileID(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return -int(h.Sum32()>>1) - 1
+}
+
+// source returns how the notifier cache should load notifiers in mode
+func (nf *notifierFiles) source(mode string) (func() ([]Notifier, error), error) {
+	switch mode {
+	case notifierDirMerge:
+		return func() ([]Notifier, error) {
+			stored, err := nf.store.List()
+			if err != nil {
+				return nil, err
+			}
+			files, err := nf.load()
+			if err != nil {
+				return nil, err
+			}
+			return append(stored, files...), nil
+		}, nil
+	case notifierDirReplace:
+		return nf.load, nil
+	case notifierDirSync:
+		return nf.store.List, nil
+	}
+	return nil, fmt.Errorf("unknown notifier dir mode %q", mode)
+}
+
+// sync makes the notifiers in the store that came from files match the
+// files, they are matched on their key. Notifiers created through the API or
+// by hand are left alone.
+func (nf *notifierFiles) sync() error {
+	err := nf.syncOnce()
+	if err != nil {
+		// Other instances sync the same files, the unique index on file_key
+		// fails our create when one of them was first. Trying again finds the
+		// notifier it created.
+		log.Println("[FILES] Could not sync notifiers, trying again: ", err)
+		err = nf.syncOnce()
+	}
+	return err
+}
+
+func (nf *notifierFiles) syncOnce() error {
+	defined, err := nf.load()
+	if err != nil {
+		return err
+	}
+
+	stored, err := nf.store.List()
+	if err != nil {
+		return err
+	}
+	existing := map[string]Notifier{}
+	// stale are notifiers with a key that is already taken, they are removed
+	stale := []Notifier{}
+	for _, n := range stored {
+		if n.Source != notifierFileSource {
+			continue
+		}
+		if _, ok := existing[n.FileKey]; ok {
+			stale = append(stale, n)
+			continue
+		}
+		existing[n.FileKey] = n
+	}
+
+	var created, updated, deleted int
+	for _, n := range defined {
+		current, ok := existing[n.FileKey]
+		delete(existing, n.FileKey)
+
+		if !ok {
+			err = nf.store.Create(&n)
+			if err != nil {
+				return err
+			}
+			created++
+			continue
+		}
+
+		if current.Application == n.Application && current.EventName == n.EventName && current.NotificationType == n.NotificationType &&
+			current.Target == n.Target && current.Template == n.Template && bytes.Equal(current.Rules, n.Rules) &&
+			current.MaxRetries == n.MaxRetries && current.Enabled == n.Enabled && bytes.Equal(current.Schedule, n.Schedule) &&
+			bytes.Equal(current.Throttle, n.Throttle) {
+			continue
+		}
+		// Snoozing is done through the API, not in files
+		n.ID = current.ID
+		n.SnoozedUntil = current.SnoozedUntil
+		err = nf.store.Update(n)
+		if err != nil {
+			return err
+		}
+		updated++
+	}
+
+	for _, n := range existing {
+		stale = append(stale, n)
+	}
+	for _, n := range stale {
+		err = nf.store.Delete(n.ID)
+		if err != nil {
+			return err
+		}
+		deleted++
+	}
+
+	log.Printf("[FILES] synced notifiers, created %d, updated %d, deleted %d\n", created, updated, deleted)
+	return nil
+}
+
+// fingerprint changes whenever a file in the directory is added, removed or
+// modified
+func (nf *notifierFiles) fingerprint() (string, error) {
+	paths, err := nf.paths()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&b, "%s %d %d\n", path, info.Size(), info.ModTime().UnixNano())
+	}
+	return b.String(), nil
+}
+
+// watch polls the directory and calls changed whenever the files change
+func (nf *notifierFiles) watch(interval time.Duration, changed func() error) {
+	last, _ := nf.fingerprint()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		current, err := nf.fingerprint()
+		if err != nil {
+			log.Println("[FILES] Could not read notifier dir: ", err)
+			continue
+		}
+		if current == last {
+			continue
+		}
+
+		log.Println("[FILES] notifier files changed, reloading")
+		err = changed()
+		if err != nil {
+			log.Println("[FILES] Could not reload notifier files: ", err)
+			continue
+		}
+		last = current
+	}
+}
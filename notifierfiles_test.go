@@ -0,0 +1,157 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeNotifierFile(t *testing.T, dir string, name string, content string) {
+	err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644)
+	assert.Nil(t, err)
+}
+
+func TestNotifierFilesLoad(t *testing.T) {
+	dir := t.TempDir()
+	writeNotifierFile(t, dir, "signups.yaml", `
+notifiers:
+  - key: signups
+    application: app
+    event_name: signup
+    template: "{{ .name }} signed up"
+    notification_type: slack
+    target: "#signups"
+    rules:
+      - key: number
+        type: number
+        setting: gt
+        value: 10
+`)
+	writeNotifierFile(t, dir, "orders.json", `{"notifiers": [{"key": "orders", "application": "app", "event_name": "order", "notification_type": "email", "target": "sales@example.com", "max_retries": 0}]}`)
+	writeNotifierFile(t, dir, "README.md", "not a notifier")
+
+	notifiers, err := newNotifierFiles(dir, newMemoryNotifierStore()).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(notifiers))
+
+	order := notifiers[0]
+	assert.Equal(t, "order", order.EventName)
+	assert.Equal(t, 0, order.MaxRetries)
+	assert.True(t, order.ID < 0)
+	assert.Equal(t, "orders", order.FileKey)
+	assert.Equal(t, fileID("orders"), order.ID)
+
+	signup := notifiers[1]
+	assert.Equal(t, 3, signup.MaxRetries)
+	assert.Equal(t, notifierFileSource, signup.Source)
+	assert.JSONEq(t, `[{"key": "number", "type": "number", "setting": "gt", "value": "10"}]`, string(signup.Rules))
+}
+
+func TestNotifierFileIDsAreStable(t *testing.T) {
+	dir := t.TempDir()
+	writeNotifierFile(t, dir, "signups.yaml", "notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n")
+	notifiers, err := newNotifierFiles(dir, newMemoryNotifierStore()).load()
+	assert.Nil(t, err)
+	signupID := notifiers[0].ID
+
+	writeNotifierFile(t, dir, "orders.yaml", "notifiers:\n  - key: orders\n    application: app\n    event_name: order\n    notification_type: slack\n")
+	notifiers, err = newNotifierFiles(dir, newMemoryNotifierStore()).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(notifiers))
+	assert.Equal(t, "order", notifiers[0].EventName)
+	assert.Equal(t, signupID, notifiers[1].ID)
+	assert.NotEqual(t, notifiers[0].ID, notifiers[1].ID)
+}
+
+func TestNotifierFilesInvalid(t *testing.T) {
+	invalid := []string{
+		"notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: pigeon\n",
+		"notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n    template: \"{{ .name \"\n",
+		"notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n    channel: \"#general\"\n",
+		"notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n    rules:\n      - key: number\n        type: number\n        setting: around\n        value: 10\n",
+		"notifiers:\n  - application: app\n    event_name: signup\n    notification_type: slack\n",
+	}
+	for _, content := range invalid {
+		dir := t.TempDir()
+		writeNotifierFile(t, dir, "notifiers.yaml", content)
+		_, err := newNotifierFiles(dir, newMemoryNotifierStore()).load()
+		assert.NotNil(t, err, content)
+	}
+}
+
+func TestNotifierFilesDuplicate(t *testing.T) {
+	dir := t.TempDir()
+	writeNotifierFile(t, dir, "a.yaml", "notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n")
+	writeNotifierFile(t, dir, "b.yaml", "notifiers:\n  - key: signups\n    application: app\n    event_name: order\n    notification_type: slack\n")
+
+	_, err := newNotifierFiles(dir, newMemoryNotifierStore()).load()
+	assert.NotNil(t, err)
+
+	// Notifiers for the same event and target are fine with their own key
+	writeNotifierFile(t, dir, "b.yaml", "notifiers:\n  - key: vip-signups\n    application: app\n    event_name: signup\n    notification_type: slack\n    template: VIP\n")
+	notifiers, err := newNotifierFiles(dir, newMemoryNotifierStore()).load()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(notifiers))
+}
+
+func TestNotifierFilesSync(t *testing.T) {
+	dir := t.TempDir()
+	store := newMemoryNotifierStore()
+	nf := newNotifierFiles(dir, store)
+	manual := Notifier{Application: "app", EventName: "signup", NotificationType: "slack"}
+	store.Create(&manual)
+	// Left behind by instances syncing at the same time
+	for i := 0; i < 2; i++ {
+		store.Create(&Notifier{Application: "app", EventName: "signup", NotificationType: "slack", Source: notifierFileSource, FileKey: "signups"})
+	}
+
+	writeNotifierFile(t, dir, "a.yaml", "notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n    target: \"#signups\"\n")
+	assert.Nil(t, nf.sync())
+	notifiers, _ := store.List()
+	assert.Equal(t, 2, len(notifiers))
+	synced := notifiers[1]
+	assert.Equal(t, "signups", synced.FileKey)
+	assert.Equal(t, "#signups", synced.Target)
+
+	// Changing the target updates the same notifier
+	writeNotifierFile(t, dir, "a.yaml", "notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n    target: \"#general\"\n")
+	assert.Nil(t, nf.sync())
+	n, err := store.Get(synced.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "#general", n.Target)
+
+	writeNotifierFile(t, dir, "a.yaml", "notifiers: []\n")
+	assert.Nil(t, nf.sync())
+	notifiers, _ = store.List()
+	assert.Equal(t, []Notifier{manual}, notifiers)
+}
+
+func TestNotifierFilesSource(t *testing.T) {
+	dir := t.TempDir()
+	writeNotifierFile(t, dir, "a.yaml", "notifiers:\n  - key: signups\n    application: app\n    event_name: signup\n    notification_type: slack\n")
+	nf := newNotifierFiles(dir, newMemoryNotifierStore())
+
+	load, err := nf.source(notifierDirReplace)
+	assert.Nil(t, err)
+	notifiers, err := load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(notifiers))
+
+	_, err = nf.source("mirror")
+	assert.NotNil(t, err)
+}
+
+func TestNotifierFilesFingerprint(t *testing.T) {
+	dir := t.TempDir()
+	nf := newNotifierFiles(dir, newMemoryNotifierStore())
+	writeNotifierFile(t, dir, "a.yaml", "notifiers: []\n")
+	before, err := nf.fingerprint()
+	assert.Nil(t, err)
+
+	writeNotifierFile(t, dir, "b.yaml", "notifiers: []\n")
+	after, err := nf.fingerprint()
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, after)
+}
@@ -2,9 +2,14 @@ package notifiers
 
 import (
 	"bytes"
-	"log"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
 	"net/smtp"
+	"net/textproto"
 	"text/template"
+	"time"
 )
 
 // EmailNotifier is a notifier accountable for e-mailing notifications
@@ -30,32 +35,96 @@ type emailData struct {
 	Body    string
 }
 
-// SendMessage sends an event with processed data to a selected email address (target)
-func (e *EmailNotifier) SendMessage(target string, eventName string, data []byte) {
+// SendMessage sends an event with processed data to a selected email address
+// (target). Connection problems and temporary (4xx) SMTP errors are retryable.
+func (e *EmailNotifier) SendMessage(ctx context.Context, target string, eventName string, body []byte) DeliveryResult {
 	var err error
 	var doc bytes.Buffer
+	start := time.Now()
 
 	t := template.New("emailTemplate")
 	t, err = t.Parse(emailTemplate)
 	if err != nil {
-		log.Fatal("t.Parse ", err)
+		return failed(fmt.Errorf("t.Parse: %s", err), false, start)
 	}
-	context := &emailData{
+	email := &emailData{
 		From:    "Springest Dev <developers@springest.nl>",
 		To:      target,
 		Subject: "Email subject line",
-		Body:    string(data),
+		Body:    string(body),
 	}
-	err = t.Execute(&doc, context)
+	err = t.Execute(&doc, email)
 	if err != nil {
-		log.Fatal("t.Execute ", err)
+		return failed(fmt.Errorf("t.Execute: %s", err), false, start)
 	}
 
 	// TODO: setup env variables to support multiple envs
 	// TODO: Set up real test mode instead of using mailcatcher
 	auth := smtp.PlainAuth("", "", "", "localhost:1025")
-	err = smtp.SendMail("localhost:1025", auth, "test@example.com", []string{"recipient@example.com"}, doc.Bytes())
+	err = sendMail(ctx, "localhost:1025", auth, "test@example.com", []string{"recipient@example.com"}, doc.Bytes())
 	if err != nil {
-		log.Fatal("smtp.SendMail ", err)
+		// Only permanent (5xx) SMTP errors are worth giving up on
+		retryable := true
+		if tpErr, ok := err.(*textproto.Error); ok {
+			retryable = tpErr.Code < 500
+		}
+		return failed(fmt.Errorf("sendMail: %s", err), retryable, start)
 	}
+	return DeliveryResult{Latency: time.Since(start)}
+}
+
+// sendMail works like smtp.SendMail, but gives up when ctx is done
+func sendMail(ctx context.Context, addr string, a smtp.Auth, from string, to []string, msg []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		err = c.StartTLS(&tls.Config{ServerName: host})
+		if err != nil {
+			return err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && a != nil {
+		err = c.Auth(a)
+		if err != nil {
+			return err
+		}
+	}
+	err = c.Mail(from)
+	if err != nil {
+		return err
+	}
+	for _, addr := range to {
+		err = c.Rcpt(addr)
+		if err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return err
+	}
+	err = w.Close()
+	if err != nil {
+		return err
+	}
+	return c.Quit()
 }
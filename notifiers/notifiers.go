@@ -1,6 +1,33 @@
 package notifiers
 
+import (
+	"context"
+	"time"
+)
+
 // MessageNotifier defines our interface that all our notifications need to adhere too, also handy to swap out in test
 type MessageNotifier interface {
-	SendMessage(string, string, []byte)
+	SendMessage(ctx context.Context, target string, eventName string, data []byte) DeliveryResult
+}
+
+// DeliveryResult describes the outcome of sending a notification
+type DeliveryResult struct {
+	// Err is set when the notification could not be delivered
+	Err error
+	// Response holds what the provider responded, if anything
+	Response string
+	Latency  time.Duration
+	// Retryable tells whether sending the same notification again later
+	// might succeed
+	Retryable bool
+}
+
+// failed returns a result for a delivery that failed before it reached the
+// provider
+func failed(err error, retryable bool, start time.Time) DeliveryResult {
+	return DeliveryResult{
+		Err:       err,
+		Latency:   time.Since(start),
+		Retryable: retryable,
+	}
 }
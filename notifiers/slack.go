@@ -2,10 +2,13 @@ package notifiers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"time"
 )
 
 // SlackNotifier is a notifier accountable for sending notifications to Slack
@@ -18,22 +21,46 @@ type SlackPayload struct {
 	Text    string `json:"text"`
 }
 
-// SendMessage sends an event with processed data to a selected Slack channel (target)
-func (s *SlackNotifier) SendMessage(target string, eventName string, data []byte) {
+// SendMessage sends an event with processed data to a selected Slack channel
+// (target). Network errors, rate limiting and server errors are retryable.
+func (s *SlackNotifier) SendMessage(ctx context.Context, target string, eventName string, data []byte) DeliveryResult {
+	start := time.Now()
 	payload := SlackPayload{
 		Channel: target,
 		Text:    string(data),
 	}
 
 	payloadEnc, err := json.Marshal(payload)
+	if err != nil {
+		return failed(err, false, start)
+	}
 	payloadReader := bytes.NewReader(payloadEnc)
 
-	slackResp, err := http.Post(s.HookURL, "application/json", payloadReader)
-	defer slackResp.Body.Close()
+	req, err := http.NewRequestWithContext(ctx, "POST", s.HookURL, payloadReader)
+	if err != nil {
+		return failed(err, false, start)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	slackResp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		panic(err)
+		return failed(err, true, start)
 	}
+	defer slackResp.Body.Close()
 
 	slackBody, err := ioutil.ReadAll(slackResp.Body)
+	if err != nil {
+		return failed(err, true, start)
+	}
 	log.Println("Slack Response:", string(slackBody))
+
+	result := DeliveryResult{
+		Response: string(slackBody),
+		Latency:  time.Since(start),
+	}
+	if slackResp.StatusCode != http.StatusOK {
+		result.Err = fmt.Errorf("Slack responded with %d: %s", slackResp.StatusCode, string(slackBody))
+		result.Retryable = slackResp.StatusCode == http.StatusTooManyRequests || slackResp.StatusCode >= 500
+	}
+	return result
 }
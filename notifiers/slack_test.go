@@ -0,0 +1,51 @@
+package notifiers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func slackServer(status int, body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+}
+
+func TestSlackDelivered(t *testing.T) {
+	server := slackServer(http.StatusOK, "ok")
+	defer server.Close()
+
+	s := SlackNotifier{HookURL: server.URL}
+	res := s.SendMessage(context.Background(), "#general", "signup", []byte("hi"))
+
+	assert.Nil(t, res.Err)
+	assert.Equal(t, "ok", res.Response)
+}
+
+func TestSlackServerErrorIsRetryable(t *testing.T) {
+	server := slackServer(http.StatusServiceUnavailable, "unavailable")
+	defer server.Close()
+
+	s := SlackNotifier{HookURL: server.URL}
+	res := s.SendMessage(context.Background(), "#general", "signup", []byte("hi"))
+
+	assert.NotNil(t, res.Err)
+	assert.True(t, res.Retryable)
+}
+
+func TestSlackClientErrorIsNotRetryable(t *testing.T) {
+	server := slackServer(http.StatusNotFound, "channel_not_found")
+	defer server.Close()
+
+	s := SlackNotifier{HookURL: server.URL}
+	res := s.SendMessage(context.Background(), "#nope", "signup", []byte("hi"))
+
+	assert.NotNil(t, res.Err)
+	assert.False(t, res.Retryable)
+	assert.Equal(t, "channel_not_found", res.Response)
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/lib/pq"
+)
+
+// NotifierStore keeps our notifiers. Get, Update and Delete return
+// sql.ErrNoRows when there is no notifier with the given ID.
+type NotifierStore interface {
+	Lookup(application string, eventName string) ([]Notifier, error)
+	List() ([]Notifier, error)
+	Get(id int) (Notifier, error)
+	Create(n *Notifier) error
+	Update(n Notifier) error
+	Delete(id int) error
+	// Changes receives a value whenever notifiers might have changed
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// Kinds of notifier stores
+const (
+	notifierStorePostgres = "postgres"
+	notifierStoreSQLite   = "sqlite"
+	notifierStoreMemory   = "memory"
+)
+
+// notifiersChannel is the Postgres channel our trigger notifies when the
+// notifiers table changes
+const notifiersChannel = "notifiers_changed"
+
+// notifierStore is where the API and notifier cache read and write notifiers
+var notifierStore NotifierStore
+
+// sqlNotifierStore stores notifiers in Postgres or SQLite, queries are
+// written with ? placeholders and rebound for the driver
+type sqlNotifierStore struct {
+	db       *sqlx.DB
+	changes  chan struct{}
+	listener *pq.Listener
+}
+
+// newPostgresNotifierStore uses the notifiers table in Postgres, changes made
+// by other instances are picked up through the trigger on that table
+func newPostgresNotifierStore(db *sqlx.DB, pgStr string) (*sqlNotifierStore, error) {
+	s := &sqlNotifierStore{db: db, changes: make(chan struct{}, 1)}
+
+	s.listener = pq.NewListener(pgStr, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Println("[STORE] listener: ", err)
+		}
+	})
+	err := s.listener.Listen(notifiersChannel)
+	if err != nil {
+		s.listener.Close()
+		return nil, err
+	}
+
+	go func() {
+		// A nil notification means the connection was re-established, we
+		// might have missed changes in the meantime
+		for range s.listener.Notify {
+			s.changed()
+		}
+	}()
+	return s, nil
+}
+
+func (s *sqlNotifierStore) Lookup(application string, eventName string) ([]Notifier, error) {
+	notifiers := []Notifier{}
+	err := s.db.Select(&notifiers, s.db.Rebind("SELECT * FROM notifiers WHERE application=? AND event_name=? ORDER BY id"), application, eventName)
+	return notifiers, err
+}
+
+func (s *sqlNotifierStore) List() ([]Notifier, error) {
+	notifiers := []Notifier{}
+	err := s.db.Select(&notifiers, "SELECT * FROM notifiers ORDER BY id")
+	return notifiers, err
+}
+
+func (s *sqlNotifierStore) Get(id int) (Notifier, error) {
+	n := Notifier{}
+	err := s.db.Get(&n, s.db.Rebind("SELECT * FROM notifiers WHERE id=?"), id)
+	return n, err
+}
+
+func (s *sqlNotifierStore) Create(n *Notifier) error {
+	err := s.db.QueryRow(s.db.Rebind(`INSERT INTO notifiers
+		(application, event_name, template, rules, notification_type, target, max_retries, source, file_key, enabled, snoozed_until, schedule, throttle)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING id`),
+		n.Application, n.EventName, n.Template, n.Rules, n.NotificationType, n.Target, n.MaxRetries, n.Source, n.FileKey,
+		n.Enabled, n.SnoozedUntil, n.Schedule, n.Throttle,
+	).Scan(&n.ID)
+	if err != nil {
+		return err
+	}
+
+	s.changed()
+	return nil
+}
+
+func (s *sqlNotifierStore) Update(n Notifier) error {
+	res, err := s.db.Exec(s.db.Rebind(`UPDATE notifiers SET application=?, event_name=?, template=?,
+		rules=?, notification_type=?, target=?, max_retries=?, source=?, file_key=?, enabled=?, snoozed_until=?,
+		schedule=?, throttle=? WHERE id=?`),
+		n.Application, n.EventName, n.Template, n.Rules, n.NotificationType, n.Target, n.MaxRetries, n.Source, n.FileKey,
+		n.Enabled, n.SnoozedUntil, n.Schedule, n.Throttle, n.ID,
+	)
+	err = affectedOne(res, err)
+	if err != nil {
+		return err
+	}
+
+	s.changed()
+	return nil
+}
+
+func (s *sqlNotifierStore) Delete(id int) error {
+	res, err := s.db.Exec(s.db.Rebind("DELETE FROM notifiers WHERE id=?"), id)
+	err = affectedOne(res, err)
+	if err != nil {
+		return err
+	}
+
+	s.changed()
+	return nil
+}
+
+func (s *sqlNotifierStore) Changes() <-chan struct{} {
+	return s.changes
+}
+
+// Close stops listening for changes, the Postgres connection pool is shared
+// and closed separately
+func (s *sqlNotifierStore) Close() error {
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return s.db.Close()
+}
+
+// changed signals a change without blocking, a pending signal already covers
+// this one
+func (s *sqlNotifierStore) changed() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+func affectedOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// memoryNotifierStore keeps notifiers in memory, they are gone when we stop
+type memoryNotifierStore struct {
+	mu        sync.Mutex
+	notifiers map[int]Notifier
+	nextID    int
+	changes   chan struct{}
+}
+
+func newMemoryNotifierStore() *memoryNotifierStore {
+	return &memoryNotifierStore{
+		notifiers: map[int]Notifier{},
+		nextID:    1,
+		changes:   make(chan struct{}, 1),
+	}
+}
+
+func (s *memoryNotifierStore) Lookup(application string, eventName string) ([]Notifier, error) {
+	all, _ := s.List()
+
+	notifiers := []Notifier{}
+	for _, n := range all {
+		if n.Application == application && n.EventName == eventName {
+			notifiers = append(notifiers, n)
+		}
+	}
+	return notifiers, nil
+}
+
+func (s *memoryNotifierStore) List() ([]Notifier, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	notifiers := make([]Notifier, 0, len(s.notifiers))
+	for _, n := range s.notifiers {
+		notifiers = append(notifiers, n)
+	}
+	sort.Slice(notifiers, func(i, j int) bool {
+		return notifiers[i].ID < notifiers[j].ID
+	})
+	return notifiers, nil
+}
+
+func (s *memoryNotifierStore) Get(id int) (Notifier, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, ok := s.notifiers[id]
+	if !ok {
+		return Notifier{}, sql.ErrNoRows
+	}
+	return n, nil
+}
+
+func (s *memoryNotifierStore) Create(n *Notifier) error {
+	s.mu.Lock()
+	n.ID = s.nextID
+	s.nextID++
+	s.notifiers[n.ID] = *n
+	s.mu.Unlock()
+
+	s.changed()
+	return nil
+}
+
+func (s *memoryNotifierStore) Update(n Notifier) error {
+	s.mu.Lock()
+	_, ok := s.notifiers[n.ID]
+	if ok {
+		s.notifiers[n.ID] = n
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.changed()
+	return nil
+}
+
+func (s *memoryNotifierStore) Delete(id int) error {
+	s.mu.Lock()
+	_, ok := s.notifiers[id]
+	delete(s.notifiers, id)
+	s.mu.Unlock()
+
+	if !ok {
+		return sql.ErrNoRows
+	}
+	s.changed()
+	return nil
+}
+
+func (s *memoryNotifierStore) Changes() <-chan struct{} {
+	return s.changes
+}
+
+func (s *memoryNotifierStore) Close() error {
+	return nil
+}
+
+func (s *memoryNotifierStore) changed() {
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// openNotifierStore returns the store configured in C, db is only used for
+// Postgres
+func openNotifierStore(kind string, db *sqlx.DB, pgStr string, path string) (NotifierStore, error) {
+	switch kind {
+	case notifierStorePostgres:
+		return newPostgresNotifierStore(db, pgStr)
+	case notifierStoreSQLite:
+		return newSQLiteNotifierStore(path)
+	case notifierStoreMemory:
+		return newMemoryNotifierStore(), nil
+	}
+	return nil, fmt.Errorf("unknown notifier store %q", kind)
+}
@@ -0,0 +1,11 @@
+//go:build !cgo
+
+package main
+
+import "errors"
+
+// newSQLiteNotifierStore is not available without cgo, the SQLite driver
+// needs it
+func newSQLiteNotifierStore(path string) (*sqlNotifierStore, error) {
+	return nil, errors.New("the sqlite notifier store needs a binary built with cgo")
+}
@@ -0,0 +1,42 @@
+//go:build cgo
+
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the notifiers table in a new SQLite database
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS notifiers(
+  id integer primary key autoincrement,
+  application text,
+  event_name text,
+  template text,
+  rules text NOT NULL DEFAULT '[]',
+  notification_type text,
+  target text,
+  max_retries integer NOT NULL DEFAULT 3,
+  source text NOT NULL DEFAULT '',
+  file_key text NOT NULL DEFAULT '',
+  enabled boolean NOT NULL DEFAULT true,
+  snoozed_until timestamp,
+  schedule text NOT NULL DEFAULT '[]',
+  throttle text NOT NULL DEFAULT '{}'
+);
+CREATE INDEX IF NOT EXISTS index_application_event_name ON notifiers (application, event_name);
+CREATE UNIQUE INDEX IF NOT EXISTS index_notifiers_file_key ON notifiers (file_key) WHERE source = 'file' AND file_key <> '';`
+
+// newSQLiteNotifierStore opens or creates a SQLite database at path
+func newSQLiteNotifierStore(path string) (*sqlNotifierStore, error) {
+	sqlite, err := sqlx.Connect("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	_, err = sqlite.Exec(sqliteSchema)
+	if err != nil {
+		sqlite.Close()
+		return nil, err
+	}
+	return &sqlNotifierStore{db: sqlite, changes: make(chan struct{}, 1)}, nil
+}
@@ -0,0 +1,36 @@
+//go:build cgo
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSQLiteNotifierStore(t *testing.T) {
+	store, err := newSQLiteNotifierStore(filepath.Join(t.TempDir(), "notifiers.db"))
+	assert.Nil(t, err)
+	testNotifierStore(t, store)
+}
+
+func TestOpenUnknownNotifierStore(t *testing.T) {
+	_, err := openNotifierStore("redis", nil, "", "")
+	assert.NotNil(t, err)
+}
+
+func TestSQLiteNotifierStoreFileKeyIsUnique(t *testing.T) {
+	store, err := newSQLiteNotifierStore(filepath.Join(t.TempDir(), "notifiers.db"))
+	assert.Nil(t, err)
+	defer store.Close()
+
+	n := Notifier{Application: "app", EventName: "signup", NotificationType: "slack", Source: notifierFileSource, FileKey: "signups"}
+	assert.Nil(t, store.Create(&n))
+	assert.NotNil(t, store.Create(&n))
+
+	// Only keys of notifiers from files are unique
+	n = Notifier{Application: "app", EventName: "signup", NotificationType: "slack"}
+	assert.Nil(t, store.Create(&n))
+	assert.Nil(t, store.Create(&n))
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func testNotifierStore(t *testing.T, store NotifierStore) {
+	signup := Notifier{Application: "app", EventName: "signup", Template: "{{ .name }}", Rules: types.JSONText(`[]`), NotificationType: "slack", MaxRetries: 3, Schedule: types.JSONText(`[]`)}
+	order := Notifier{Application: "app", EventName: "order", Rules: types.JSONText(`[]`), NotificationType: "email", Schedule: types.JSONText(`[]`)}
+	assert.Nil(t, store.Create(&signup))
+	assert.Nil(t, store.Create(&order))
+	assert.NotEqual(t, signup.ID, order.ID)
+
+	// Every write is signalled, pending signals are coalesced
+	<-store.Changes()
+
+	all, err := store.List()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(all))
+
+	found, err := store.Lookup("app", "signup")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(found))
+	assert.Equal(t, "{{ .name }}", found[0].Template)
+
+	until := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+	signup.Target = "#signups"
+	signup.Enabled = true
+	signup.SnoozedUntil = &until
+	assert.Nil(t, store.Update(signup))
+	n, err := store.Get(signup.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, "#signups", n.Target)
+	assert.True(t, n.Enabled)
+	assert.True(t, until.Equal(*n.SnoozedUntil))
+
+	assert.Nil(t, store.Delete(signup.ID))
+	_, err = store.Get(signup.ID)
+	assert.True(t, isNotFound(err))
+	assert.True(t, isNotFound(store.Update(signup)))
+	assert.True(t, isNotFound(store.Delete(signup.ID)))
+
+	assert.Nil(t, store.Close())
+}
+
+func TestMemoryNotifierStore(t *testing.T) {
+	testNotifierStore(t, newMemoryNotifierStore())
+}
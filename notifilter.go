@@ -1,23 +1,46 @@
 package main
 
 import (
-	"crypto/sha1"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/bittersweet/notifilter-receive/elasticsearch"
+	"github.com/bittersweet/notifilter-receive/spool"
 	"github.com/jmoiron/sqlx"
 	"github.com/jmoiron/sqlx/types"
 	"github.com/kelseyhightower/envconfig"
 	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const maxPacketSize = 1024 * 1024
 
+// errQueueFull is returned to senders that can not wait for room on the
+// tasks channel
+var errQueueFull = errors.New("queue is full")
+
+// errSpoolUnavailable is returned to senders when their event could not be
+// written to the spool, so we can not guarantee it will be processed
+var errSpoolUnavailable = errors.New("spool is unavailable")
+
+// errMissingFields is returned for events without an application or identifier
+var errMissingFields = errors.New("application and identifier are required")
+
+// errShuttingDown is returned to senders when we stopped accepting events
+var errShuttingDown = errors.New("shutting down")
+
 // db holds our connection pool to Postgres
 var db *sqlx.DB
 
@@ -27,6 +50,13 @@ var C Config
 // ESClient is a global variable that points to our ES client
 var ESClient elasticsearch.Client
 
+// eventSpool keeps queued events on disk until they are processed, it is nil
+// when spooling is disabled
+var eventSpool *spool.Spool
+
+// udpListening is set while listenToUDP is reading from its connection
+var udpListening int32
+
 // Time the app started up
 var startTime = time.Now()
 
@@ -41,6 +71,74 @@ type Config struct {
 	ESHost       string `default:"127.0.0.1"`
 	ESPort       int    `default:"9200"`
 	SlackHookURL string `required:"true"`
+
+	// Optional listeners next to UDP, a zero port or empty path disables them
+	TCPPort              int           `default:"0"`
+	TCPFraming           string        `default:"newline"`
+	UnixSocketPath       string        `default:""`
+	UnixSocketFraming    string        `default:"newline"`
+	StreamReadTimeout    time.Duration `default:"30s"`
+	StreamMaxConnections int           `default:"128"`
+
+	// Optional write-ahead spool, an empty directory disables it
+	SpoolDir         string `default:""`
+	SpoolSegmentSize int64  `default:"67108864"`
+
+	// Size of the queue that buffers incoming events, and the workers and
+	// queue of each stage that processes them
+	QueueCapacity      int `default:"10000"`
+	PersistWorkers     int `default:"4"`
+	NotifyWorkers      int `default:"4"`
+	StageQueueCapacity int `default:"1000"`
+
+	// How many rejected payloads we keep for /v1/statistics, and how many
+	// rejections we skip between samples
+	RejectedSampleSize int `default:"50"`
+	RejectedSampleRate int `default:"1"`
+
+	// Maximum distinct values per label on /metrics, further values are
+	// reported as "other"
+	MetricsMaxLabelValues int `default:"200"`
+
+	// /readyz fails when the queue is filled beyond this fraction of its
+	// capacity, or when checking a dependency takes longer than the timeout
+	ReadyQueueThreshold float64       `default:"0.9"`
+	ReadyTimeout        time.Duration `default:"2s"`
+
+	// Notifiers are kept in Postgres, SQLite (in the database at
+	// NotifierStorePath) or in memory
+	NotifierStore     string `default:"postgres"`
+	NotifierStorePath string `default:"notifilter.db"`
+
+	// Notifiers are cached and reloaded when the store tells us about a
+	// change, and every NotifierReloadInterval in case we missed one
+	NotifierReloadInterval time.Duration `default:"5m"`
+
+	// Notifiers can also be defined in YAML or JSON files in NotifierDir. They
+	// are used next to the ones in the store (merge), instead of them
+	// (replace) or written to the store (sync), and reloaded when they change.
+	NotifierDir             string
+	NotifierDirMode         string        `default:"merge"`
+	NotifierDirPollInterval time.Duration `default:"10s"`
+
+	// Time zone of datetime rules that check the time of day or the day of
+	// the week, unless the rule has its own
+	RuleTimeZone string `default:"UTC"`
+
+	// How long we wait for Slack or SMTP to accept a notification
+	NotifyTimeout time.Duration `default:"10s"`
+
+	// Failed notifications are retried after a random delay of up to
+	// RetryBaseDelay, doubling every attempt up to RetryMaxDelay
+	RetryBaseDelay time.Duration `default:"500ms"`
+	RetryMaxDelay  time.Duration `default:"30s"`
+
+	// Events that could not be persisted are retried with the same backoff,
+	// after that they stay in the spool until the next start
+	PersistRetries int `default:"10"`
+
+	// How long we wait for queued events to be processed when shutting down
+	ShutdownTimeout time.Duration `default:"30s"`
 }
 
 // Event will hold incoming data and will be persisted to ES eventually
@@ -49,6 +147,22 @@ type Event struct {
 	Identifier  string `json:"identifier"`
 	requestID   string
 	Data        types.JSONText `json:"data"`
+	// ReceivedAt is set when the event is queued, and kept in the spool so
+	// replayed events keep the time they were received
+	ReceivedAt time.Time `json:"received_at"`
+	stages     *stages
+	// notified is set on replayed events that were already checked for
+	// notifications, so they are only persisted
+	notified bool
+}
+
+// receivedTime returns when the event was received, now for events that did
+// not pass through the pipeline
+func (e *Event) receivedTime() time.Time {
+	if e.ReceivedAt.IsZero() {
+		return time.Now()
+	}
+	return e.ReceivedAt
 }
 
 // dataToMap transforms the raw JSON data into a map
@@ -56,110 +170,130 @@ func (e *Event) dataToMap() map[string]interface{} {
 	m := map[string]interface{}{}
 	err := e.Data.Unmarshal(&m)
 	if err != nil {
-		e.log("Error in dataToMap():", err)
+		e.log("Error in dataToMap(): %s", err)
 		return map[string]interface{}{}
 	}
 	return m
 }
 
 // persist saves the incoming event to Elasticsearch
-func (e *Event) persist() {
+func (e *Event) persist() error {
+	timer := prometheus.NewTimer(persistDuration)
+	defer timer.ObserveDuration()
+
 	err := ESClient.Persist(e.requestID, e.Application, e.Identifier, e.dataToMap())
 	if err != nil {
 		e.log("Error persisting to ElasticSearch: %s", err)
+		payload, _ := json.Marshal(e)
+		rejections.reject(rejectPersistFailed, err, payload)
 	}
+	return err
 }
 
-// notify checks to see if we have notifiers set up for this event and if the
-// rules for those notifications have been satisfied
-func (e *Event) notify() {
-	notifiers := []Notifier{}
-	err := db.Select(&notifiers, "SELECT * FROM notifiers WHERE application=$1 AND event_name=$2", e.Application, e.Identifier)
+// spool writes the event to the spool before it is queued
+func (e *Event) spool() error {
+	if eventSpool == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(e)
 	if err != nil {
-		log.Fatal("db.Select ", err)
+		return err
 	}
-	e.log("[NOTIFY] found %d notifiers", len(notifiers))
+	return eventSpool.Append(e.requestID, data)
+}
 
-	for i := 0; i < len(notifiers); i++ {
-		notifier := notifiers[i]
-		notifier.notify(e, notifier.newNotifier())
+// syncSpool makes sure the events written to the spool are on disk
+func syncSpool() error {
+	if eventSpool == nil {
+		return nil
 	}
+	return eventSpool.Sync()
 }
 
-func (e *Event) log(msg string, args ...interface{}) {
-	logStr := fmt.Sprintf(msg, args...)
-	log.Printf("%s %s\n", e.requestID, logStr)
+// ack removes the event from the spool once it has been fully processed
+func (e *Event) ack() {
+	if eventSpool == nil {
+		return
+	}
+
+	err := eventSpool.Ack(e.requestID)
+	if err != nil {
+		e.log("Error acknowledging event in spool: %s", err)
+	}
 }
 
-// incomingItems creates a channel that we can place events on so the main loop
-// can keep listening to incoming events
-func incomingItems() chan<- []byte {
-	incomingChan := make(chan []byte)
+// markDone records in the spool that a stage is done with the event
+func (e *Event) markDone(stage string) {
+	if eventSpool == nil {
+		return
+	}
 
-	// Open a channel with a capacity of 10.000 events
-	// This will only block the sender if the buffer fills up.
-	// If we do not buffer any event that gets sent to the channel will be
-	// dropped if we can not handle it.
-	tasks := make(chan Event, 10000)
+	err := eventSpool.MarkDone(e.requestID, stage)
+	if err != nil {
+		e.log("Error marking %s done in spool: %s", stage, err)
+	}
+}
 
-	// Generate unique ID to tag requests
-	// Thanks to https://blog.cloudflare.com/go-at-cloudflare/
-	idGenerator := make(chan string)
-	go func() {
-		h := sha1.New()
-		c := []byte(time.Now().String())
-		for {
-			h.Write(c)
-			idGenerator <- fmt.Sprintf("%x", h.Sum(nil))
+// notify checks to see if we have notifiers set up for this event and if the
+// rules for those notifications have been satisfied. Failing notifiers are
+// recorded but do not fail the event. Deliveries stop retrying once ctx is
+// done.
+func (e *Event) notify(ctx context.Context) error {
+	notifiers := notifierSnapshot.lookup(e.Application, e.Identifier)
+	e.log("[NOTIFY] found %d notifiers", len(notifiers))
+
+	now := time.Now()
+	for i := 0; i < len(notifiers); i++ {
+		notifier := notifiers[i]
+		if reason := notifier.pausedReason(now); reason != "" {
+			e.log("[NOTIFY] Skipping notifier id: %d, %s", notifier.ID, reason)
+			continue
 		}
-	}()
 
-	// Use 4 workers that will concurrently grab Events of the channel and
-	// persist+notify
-	for i := 0; i < 4; i++ {
-		go func() {
-			for event := range tasks {
-				event.persist()
-				event.notify()
-			}
-		}()
+		err := notifier.notify(ctx, e, notifier.newNotifier())
+		if err != nil {
+			rejections.reject(rejectNotifyFailed, fmt.Errorf("notifier %d: %s", notifier.ID, err), e.Data)
+		}
 	}
+	return nil
+}
 
-	go func() {
-		for {
-			select {
-			case b := <-incomingChan:
-				var event Event
-				err := json.Unmarshal(b, &event)
-				if err != nil {
-					log.Println(err)
-				}
-				requestID := <-idGenerator
-				event.requestID = requestID
-				tasks <- event
-			}
-		}
-	}()
+func (e *Event) log(msg string, args ...interface{}) {
+	logRequest(e.requestID, msg, args...)
+}
 
-	fmt.Println("incomingItems launched")
-	return incomingChan
+// logRequest logs a message tagged with the request it belongs to
+func logRequest(requestID string, msg string, args ...interface{}) {
+	logStr := fmt.Sprintf(msg, args...)
+	log.Printf("%s %s\n", requestID, logStr)
 }
 
-// listenToUDP opens a UDP connection that we will listen on
-func listenToUDP(conn *net.UDPConn) {
-	incomingChan := incomingItems()
+// listenToUDP reads events from a UDP connection until it is closed or quit is
+// closed
+func listenToUDP(conn *net.UDPConn, incomingChan chan<- incomingItem, quit <-chan struct{}) {
+	atomic.StoreInt32(&udpListening, 1)
+	defer atomic.StoreInt32(&udpListening, 0)
 
 	buffer := make([]byte, maxPacketSize)
 	for {
 		bytes, err := conn.Read(buffer)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("UDP read error: ", err.Error())
+			rejections.reject(rejectReadError, err, nil)
 			continue
 		}
 
 		msg := make([]byte, bytes)
 		copy(msg, buffer)
-		incomingChan <- msg
+		select {
+		case incomingChan <- incomingItem{payload: msg}:
+		case <-quit:
+			return
+		}
 	}
 }
 
@@ -173,22 +307,53 @@ func main() {
 	log.Printf("Config loaded: %#v\n", C)
 	port := fmt.Sprintf(":%d", C.AppPort)
 
-	addr, err := net.ResolveUDPAddr("udp", port)
-	if err != nil {
-		log.Fatal("ResolveUDPAddr", err)
+	// Our workers need the notifier store and Elasticsearch, so set them up
+	// before we start accepting (or replaying) events. Without Postgres there
+	// is no delivery log and there are no dead letters.
+	pgStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable", C.DBHost, C.DBUser, C.DBPassword, C.DBName)
+	if C.NotifierStore == notifierStorePostgres {
+		db, err = sqlx.Connect("postgres", pgStr)
+		if err != nil {
+			log.Fatal("DB Open()", err)
+		}
 	}
-	conn, err := net.ListenUDP("udp", addr)
+
+	notifierStore, err = openNotifierStore(C.NotifierStore, db, pgStr, C.NotifierStorePath)
 	if err != nil {
-		log.Fatal("ListenUDP", err)
+		log.Fatal("Opening notifier store ", err)
 	}
-	go listenToUDP(conn)
 
-	pgStr := fmt.Sprintf("host=%s user=%s password=%s dbname=%s sslmode=disable", C.DBHost, C.DBUser, C.DBPassword, C.DBName)
-	db, err = sqlx.Connect("postgres", pgStr)
+	load := notifierStore.List
+	var files *notifierFiles
+	if C.NotifierDir != "" {
+		files = newNotifierFiles(C.NotifierDir, notifierStore)
+		load, err = files.source(C.NotifierDirMode)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if C.NotifierDirMode == notifierDirSync {
+			err = files.sync()
+			if err != nil {
+				log.Fatal("Syncing notifier files ", err)
+			}
+		}
+	}
+
+	notifierSnapshot = newNotifierCache(load)
+	err = notifierSnapshot.reload()
 	if err != nil {
-		log.Fatal("DB Open()", err)
+		log.Fatal("Loading notifiers ", err)
+	}
+	go notifierSnapshot.listen(notifierStore.Changes(), C.NotifierReloadInterval)
+	if files != nil {
+		go files.watch(C.NotifierDirPollInterval, func() error {
+			if C.NotifierDirMode == notifierDirSync {
+				// Changes in the store reload the cache
+				return files.sync()
+			}
+			return notifierSnapshot.reload()
+		})
 	}
-	defer db.Close()
 
 	ESClient = elasticsearch.Client{
 		Host:  C.ESHost,
@@ -196,13 +361,106 @@ func main() {
 		Index: "notifilter",
 	}
 
+	rejections = newRejectionStats(C.RejectedSampleSize, C.RejectedSampleRate)
+	setMetricsLabelLimit(C.MetricsMaxLabelValues)
+
+	if C.SpoolDir != "" {
+		eventSpool, err = spool.Open(C.SpoolDir, C.SpoolSegmentSize)
+		if err != nil {
+			log.Fatal("Spool Open() ", err)
+		}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", port)
+	if err != nil {
+		log.Fatal("ResolveUDPAddr", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		log.Fatal("ListenUDP", err)
+	}
+
+	p := newPipeline(C.QueueCapacity, C.PersistWorkers, C.NotifyWorkers, C.StageQueueCapacity)
+	go listenToUDP(conn, p.incoming, p.quit)
+	registerPipelineMetrics(p)
+
+	// closers stop our listeners when shutting down
+	closers := []io.Closer{conn}
+	if C.TCPPort > 0 {
+		tcp, err := newStreamListener("tcp", fmt.Sprintf(":%d", C.TCPPort), C.TCPFraming, C.StreamReadTimeout, C.StreamMaxConnections)
+		if err != nil {
+			log.Fatal("TCP listener ", err)
+		}
+		go tcp.listen(p.incoming, p.quit)
+		closers = append(closers, tcp)
+	}
+	if C.UnixSocketPath != "" {
+		unix, err := newStreamListener("unix", C.UnixSocketPath, C.UnixSocketFraming, C.StreamReadTimeout, C.StreamMaxConnections)
+		if err != nil {
+			log.Fatal("Unix socket listener ", err)
+		}
+		go unix.listen(p.incoming, p.quit)
+		closers = append(closers, unix)
+	}
+
+	http.Handle("/v1/events", handleEvents(p.incoming))
 	http.Handle("/v1/count", handleCount(&ESClient))
-	http.Handle("/v1/statistics", handleStatistics(startTime))
+	http.Handle("/v1/statistics", handleStatistics(startTime, p))
 	http.Handle("/v1/preview", handlePreview())
+	http.Handle("/metrics", promhttp.Handler())
+	http.Handle("/healthz", handleHealth())
 
-	fmt.Printf("Will start listening on port %s\n", port)
-	err = http.ListenAndServe(port, nil)
+	checks := []readinessCheck{
+		{"elasticsearch", ESClient.Health},
+		{"udp", func(ctx context.Context) error {
+			if atomic.LoadInt32(&udpListening) == 0 {
+				return errors.New("UDP listener is not bound")
+			}
+			return nil
+		}},
+		{"queue", func(ctx context.Context) error {
+			return p.saturated(C.ReadyQueueThreshold)
+		}},
+	}
+	if db != nil {
+		checks = append(checks, readinessCheck{"postgres", db.PingContext})
+	}
+	http.Handle("/readyz", handleReady(C.ReadyTimeout, checks...))
+	registerRoutes(http.DefaultServeMux, db != nil)
+
+	server := &http.Server{Addr: port}
+	go func() {
+		fmt.Printf("Will start listening on port %s\n", port)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Fatal("ListenAndServe ", err)
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
+	log.Printf("Received %s, shutting down\n", sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), C.ShutdownTimeout)
+	defer cancel()
+
+	for _, c := range closers {
+		c.Close()
+	}
+	err = server.Shutdown(ctx)
 	if err != nil {
-		log.Fatal("ListenAndServe ", err)
+		log.Println("HTTP server Shutdown() ", err)
+	}
+
+	p.shutdown(ctx)
+
+	if eventSpool != nil {
+		eventSpool.Close()
+	}
+	notifierStore.Close()
+	if db != nil {
+		db.Close()
 	}
+	log.Println("Shutdown complete")
 }
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// incomingItem holds a raw payload received by one of our listeners. A
+// payload is either a single Event or a JSON Lines batch of them. When result
+// is set the sender waits for the outcome, and events will be rejected instead
+// of blocking when the tasks buffer is full.
+type incomingItem struct {
+	payload []byte
+	result  chan []queueResult
+}
+
+// queueResult tells a waiting sender what happened to one event of its payload
+type queueResult struct {
+	line      int
+	requestID string
+	err       error
+}
+
+// payloadLine is a single encoded event together with its line number in the
+// payload it was received in
+type payloadLine struct {
+	number int
+	data   []byte
+}
+
+// splitPayload returns the events in a payload. A payload that is valid JSON
+// on its own is a single event, even when it spans multiple lines, otherwise
+// every non-blank line is treated as a separate event.
+func splitPayload(payload []byte) []payloadLine {
+	trimmed := bytes.TrimSpace(payload)
+	if len(trimmed) == 0 {
+		return []payloadLine{}
+	}
+	if json.Valid(trimmed) {
+		return []payloadLine{{number: 1, data: trimmed}}
+	}
+
+	lines := []payloadLine{}
+	for i, line := range bytes.Split(payload, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		lines = append(lines, payloadLine{number: i + 1, data: line})
+	}
+	return lines
+}
+
+// workerPool runs one stage of the pipeline with its own queue and workers, so
+// a slow stage can not hold back the others
+type workerPool struct {
+	name    string
+	tasks   chan Event
+	size    int
+	busy    int64
+	workers sync.WaitGroup
+
+	// backlog holds up to as many events as the queue while the queue is
+	// full, slots has room for every event it can still take. Adding an event
+	// only waits once both are full.
+	mu      sync.Mutex
+	backlog []Event
+	slots   chan struct{}
+	closed  bool
+	wake    chan struct{}
+	feeder  sync.WaitGroup
+}
+
+// poolStats describes a worker pool for /v1/statistics, QueueDepth and
+// QueueCapacity include the backlog
+type poolStats struct {
+	Name          string
+	QueueDepth    int
+	QueueCapacity int
+	Backlog       int
+	Workers       int
+	BusyWorkers   int64
+}
+
+func newWorkerPool(name string, size int, capacity int) *workerPool {
+	backlog := capacity
+	if backlog < 1 {
+		backlog = 1
+	}
+	return &workerPool{
+		name:  name,
+		tasks: make(chan Event, capacity),
+		size:  size,
+		slots: make(chan struct{}, backlog),
+		wake:  make(chan struct{}, 1),
+	}
+}
+
+// add hands an event to the pool, it is queued by feed. It waits while the
+// backlog is full and returns false when the pool has been closed or abandon
+// is closed first.
+func (wp *workerPool) add(event Event, abandon <-chan struct{}) bool {
+	select {
+	case wp.slots <- struct{}{}:
+	case <-abandon:
+		return false
+	}
+
+	wp.mu.Lock()
+	if wp.closed {
+		wp.mu.Unlock()
+		<-wp.slots
+		return false
+	}
+	wp.backlog = append(wp.backlog, event)
+	wp.mu.Unlock()
+	wp.signal()
+	return true
+}
+
+// close tells feed no more events will be added, the queue is closed once the
+// backlog is queued
+func (wp *workerPool) close() {
+	wp.mu.Lock()
+	wp.closed = true
+	wp.mu.Unlock()
+	wp.signal()
+}
+
+func (wp *workerPool) signal() {
+	select {
+	case wp.wake <- struct{}{}:
+	default:
+	}
+}
+
+// feed moves the backlog to the queue in the order events were added, it
+// only waits on this stage's own workers
+func (wp *workerPool) feed() {
+	wp.feeder.Add(1)
+	go func() {
+		defer wp.feeder.Done()
+		for {
+			wp.mu.Lock()
+			if len(wp.backlog) > 0 {
+				event := wp.backlog[0]
+				wp.backlog[0] = Event{}
+				wp.backlog = wp.backlog[1:]
+				wp.mu.Unlock()
+				<-wp.slots
+
+				wp.tasks <- event
+				continue
+			}
+			closed := wp.closed
+			wp.mu.Unlock()
+
+			if closed {
+				close(wp.tasks)
+				return
+			}
+			<-wp.wake
+		}
+	}()
+}
+
+// start launches the workers, they call process for every event until the
+// queue is closed. Once abandon is closed the remaining events are skipped.
+func (wp *workerPool) start(abandon <-chan struct{}, process func(Event) error, done func(Event, error, bool)) {
+	for i := 0; i < wp.size; i++ {
+		wp.workers.Add(1)
+		go func() {
+			defer wp.workers.Done()
+			for event := range wp.tasks {
+				select {
+				case <-abandon:
+					done(event, nil, true)
+					continue
+				default:
+				}
+
+				atomic.AddInt64(&wp.busy, 1)
+				err := wp.safely(process, event)
+				atomic.AddInt64(&wp.busy, -1)
+				done(event, err, false)
+			}
+		}()
+	}
+}
+
+// safely calls process and turns a panic into an error, so a single bad event
+// can not take down a worker
+func (wp *workerPool) safely(process func(Event) error, event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic in %s worker: %v", wp.name, r)
+			event.log("%s", err)
+		}
+	}()
+	return process(event)
+}
+
+func (wp *workerPool) stats() poolStats {
+	wp.mu.Lock()
+	backlog := len(wp.backlog)
+	wp.mu.Unlock()
+
+	return poolStats{
+		Name:          wp.name,
+		QueueDepth:    len(wp.tasks) + backlog,
+		QueueCapacity: cap(wp.tasks) + cap(wp.slots),
+		Backlog:       backlog,
+		Workers:       wp.size,
+		BusyWorkers:   atomic.LoadInt64(&wp.busy),
+	}
+}
+
+// stageNotify is marked done in the spool once an event was checked for
+// notifications, so they are not sent again when it is replayed
+const stageNotify = "notify"
+
+// stages tracks an event through the persist and notify pools, it is only
+// done when both of them are. attempts counts the times persisting failed.
+type stages struct {
+	remaining int32
+	failed    int32
+	abandoned int32
+	attempts  int32
+}
+
+// pipeline decodes incoming payloads into events and hands them to the
+// persist and notify worker pools
+type pipeline struct {
+	// incoming is where our listeners place payloads so they can keep
+	// listening to incoming events
+	incoming chan incomingItem
+	// tasks buffers decoded events until they are handed to the pools
+	tasks   chan Event
+	persist *workerPool
+	notify  *workerPool
+
+	idGenerator chan string
+
+	// quit stops the incoming loop and everything that places events on the
+	// tasks channel, abandon tells the workers to stop picking up events and
+	// cancels the deliveries in progress
+	quit       chan struct{}
+	abandon    <-chan struct{}
+	ctx        context.Context
+	cancel     context.CancelFunc
+	producers  sync.WaitGroup
+	dispatcher sync.WaitGroup
+	retries    sync.WaitGroup
+
+	processed int64
+	abandoned int64
+}
+
+// newPipeline starts the incoming loop and worker pools
+func newPipeline(queueCapacity int, persistWorkers int, notifyWorkers int, stageCapacity int) *pipeline {
+	p := &pipeline{
+		incoming: make(chan incomingItem),
+		// This will only block the sender if the buffer fills up.
+		// If we do not buffer any event that gets sent to the channel will be
+		// dropped if we can not handle it.
+		tasks:       make(chan Event, queueCapacity),
+		persist:     newWorkerPool("persist", persistWorkers, stageCapacity),
+		notify:      newWorkerPool("notify", notifyWorkers, stageCapacity),
+		idGenerator: make(chan string),
+		quit:        make(chan struct{}),
+	}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.abandon = p.ctx.Done()
+
+	// Generate unique ID to tag requests
+	// Thanks to https://blog.cloudflare.com/go-at-cloudflare/
+	go func() {
+		h := sha1.New()
+		c := []byte(time.Now().String())
+		for {
+			h.Write(c)
+			select {
+			case p.idGenerator <- fmt.Sprintf("%x", h.Sum(nil)):
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+
+	p.persist.start(p.abandon, func(e Event) error { return e.persist() }, p.persistDone)
+	p.notify.start(p.abandon, func(e Event) error { return e.notify(p.ctx) }, p.notifyDone)
+
+	p.dispatch()
+	p.replay()
+	p.receive()
+
+	fmt.Println("pipeline launched")
+	return p
+}
+
+// receive decodes the payloads placed on incoming until we shut down
+func (p *pipeline) receive() {
+	p.producers.Add(1)
+	go func() {
+		defer p.producers.Done()
+		for {
+			select {
+			case item := <-p.incoming:
+				results := p.enqueue(splitPayload(item.payload), item.result == nil)
+				if item.result != nil {
+					item.result <- results
+				}
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// dispatch hands every event to both pools, replayed events that were already
+// notified about only to persist. Each pool feeds its own queue, so a stage
+// that falls behind, like notify during a Slack outage, builds up a backlog
+// instead of holding back the other one. Once that backlog is full as well
+// dispatch waits, the tasks buffer fills up and new events are rejected.
+func (p *pipeline) dispatch() {
+	p.persist.feed()
+	p.notify.feed()
+
+	p.dispatcher.Add(1)
+	go func() {
+		defer p.dispatcher.Done()
+		for event := range p.tasks {
+			select {
+			case <-p.abandon:
+				atomic.AddInt64(&p.abandoned, 1)
+				continue
+			default:
+			}
+
+			event.stages = &stages{remaining: 2}
+			if event.notified {
+				event.stages.remaining = 1
+			}
+			if !p.persist.add(event, p.abandon) {
+				atomic.AddInt64(&p.abandoned, 1)
+				continue
+			}
+			if !event.notified && !p.notify.add(event, p.abandon) {
+				p.stageDone(event, nil, true)
+			}
+		}
+		p.persist.close()
+		p.notify.close()
+	}()
+}
+
+// persistDone retries events that could not be persisted, up to
+// PersistRetries times
+func (p *pipeline) persistDone(e Event, err error, abandoned bool) {
+	if err != nil && !abandoned && p.retryPersist(e, err) {
+		return
+	}
+	p.stageDone(e, err, abandoned)
+}
+
+// retryPersist hands the event to the persist pool again after a backoff. It
+// returns false when the event has been retried often enough.
+func (p *pipeline) retryPersist(e Event, err error) bool {
+	attempt := int(atomic.AddInt32(&e.stages.attempts, 1))
+	if attempt > C.PersistRetries {
+		return false
+	}
+
+	delay := backoff(attempt, C.RetryBaseDelay, C.RetryMaxDelay)
+	e.log("Persisting failed: %s, retrying in %s", err, delay)
+	p.retries.Add(1)
+	go func() {
+		defer p.retries.Done()
+		select {
+		case <-time.After(delay):
+			if p.persist.add(e, p.abandon) {
+				return
+			}
+		case <-p.quit:
+		}
+		p.stageDone(e, err, false)
+	}()
+	return true
+}
+
+// notifyDone marks notify as done in the spool, even when some notifiers
+// failed. Those end up in the dead letters, sending the others again when the
+// event is replayed would only duplicate them.
+func (p *pipeline) notifyDone(e Event, err error, abandoned bool) {
+	if !abandoned {
+		e.markDone(stageNotify)
+	}
+	p.stageDone(e, nil, abandoned)
+}
+
+// stageDone is called when a stage is done with an event. Events stay in the
+// spool when persisting failed so they will be retried on the next start.
+func (p *pipeline) stageDone(e Event, err error, abandoned bool) {
+	if err != nil {
+		atomic.StoreInt32(&e.stages.failed, 1)
+	}
+	if abandoned {
+		atomic.StoreInt32(&e.stages.abandoned, 1)
+	}
+	if atomic.AddInt32(&e.stages.remaining, -1) > 0 {
+		return
+	}
+
+	if atomic.LoadInt32(&e.stages.abandoned) == 1 {
+		atomic.AddInt64(&p.abandoned, 1)
+		return
+	}
+	if atomic.LoadInt32(&e.stages.failed) == 0 {
+		e.ack()
+	}
+	atomic.AddInt64(&p.processed, 1)
+}
+
+// saturated returns an error when the queue or the queue and backlog of a
+// stage are filled beyond threshold, a fraction of their capacity
+func (p *pipeline) saturated(threshold float64) error {
+	for _, stats := range p.stats() {
+		if float64(stats.QueueDepth) >= threshold*float64(stats.QueueCapacity) {
+			return fmt.Errorf("%s holds %d of %d events", stats.Name, stats.QueueDepth, stats.QueueCapacity)
+		}
+	}
+	return nil
+}
+
+// stats returns the state of the queue and worker pools
+func (p *pipeline) stats() []poolStats {
+	return []poolStats{
+		{Name: "queue", QueueDepth: len(p.tasks), QueueCapacity: cap(p.tasks)},
+		p.persist.stats(),
+		p.notify.stats(),
+	}
+}
+
+// replay queues events that were spooled but not processed before we stopped,
+// before anything else
+func (p *pipeline) replay() {
+	if eventSpool == nil {
+		return
+	}
+
+	replay := eventSpool.Replay()
+	if len(replay) > 0 {
+		log.Printf("Replaying %d events from spool\n", len(replay))
+	}
+
+	p.producers.Add(1)
+	go func() {
+		defer p.producers.Done()
+		for _, rec := range replay {
+			var event Event
+			err := json.Unmarshal(rec.Data, &event)
+			if err != nil {
+				log.Printf("%s Could not decode spooled event: %s\n", rec.ID, err)
+				eventSpool.Ack(rec.ID)
+				continue
+			}
+			event.requestID = rec.ID
+			event.notified = containsString(rec.Done, stageNotify)
+
+			select {
+			case p.tasks <- event:
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+}
+
+// enqueue decodes the lines of a payload, writes them to the spool with a
+// single sync and places them on the tasks channel. When wait is false we give
+// up instead of blocking on a full buffer.
+func (p *pipeline) enqueue(lines []payloadLine, wait bool) []queueResult {
+	results := make([]queueResult, len(lines))
+	events := make([]*Event, len(lines))
+	spooled := false
+	for i, line := range lines {
+		event, res := p.decode(line)
+		results[i] = res
+		if res.err != nil {
+			continue
+		}
+
+		err := event.spool()
+		if err != nil {
+			event.log("Error writing event to spool: %s", err)
+			if !wait {
+				results[i].err = errSpoolUnavailable
+				continue
+			}
+		} else {
+			spooled = true
+		}
+		events[i] = &event
+	}
+
+	if spooled {
+		err := syncSpool()
+		if err != nil {
+			log.Printf("Error syncing spool: %s\n", err)
+			for i, event := range events {
+				if event != nil && !wait {
+					event.ack()
+					events[i] = nil
+					results[i].err = errSpoolUnavailable
+				}
+			}
+		}
+	}
+
+	for i, event := range events {
+		if event != nil {
+			results[i] = p.queue(*event, lines[i], wait)
+		}
+	}
+	return results
+}
+
+// decode turns a single line into an event with a request ID
+func (p *pipeline) decode(line payloadLine) (Event, queueResult) {
+	var event Event
+	err := json.Unmarshal(line.data, &event)
+	if err != nil {
+		log.Printf("Could not decode event on line %d: %s\n", line.number, err)
+		rejections.reject(rejectMalformed, err, line.data)
+		return event, queueResult{line: line.number, err: err}
+	}
+	if event.Application == "" || event.Identifier == "" {
+		log.Printf("Event on line %d has no application or identifier\n", line.number)
+		rejections.reject(rejectMissingFields, errMissingFields, line.data)
+		return event, queueResult{line: line.number, err: errMissingFields}
+	}
+	event.ReceivedAt = time.Now()
+	observeEventReceived(&event)
+	select {
+	case event.requestID = <-p.idGenerator:
+	case <-p.quit:
+		return event, queueResult{line: line.number, err: errShuttingDown}
+	}
+	return event, queueResult{line: line.number, requestID: event.requestID}
+}
+
+// queue places a spooled event on the tasks channel
+func (p *pipeline) queue(event Event, line payloadLine, wait bool) queueResult {
+	if wait {
+		select {
+		case p.tasks <- event:
+			return queueResult{line: line.number, requestID: event.requestID}
+		case <-p.quit:
+			event.log("Dropping event, shutting down")
+			return queueResult{line: line.number, err: errShuttingDown}
+		}
+	}
+
+	select {
+	case p.tasks <- event:
+		return queueResult{line: line.number, requestID: event.requestID}
+	default:
+		event.log("Dropping event, queue is full")
+		rejections.reject(rejectQueueFull, errQueueFull, line.data)
+		event.ack()
+		return queueResult{line: line.number, err: errQueueFull}
+	}
+}
+
+// shutdown stops accepting events and waits for the workers to drain the
+// tasks channel. Events still queued when ctx is done are abandoned, they will
+// be replayed from the spool on the next start when it is enabled.
+func (p *pipeline) shutdown(ctx context.Context) {
+	processed := atomic.LoadInt64(&p.processed)
+
+	close(p.quit)
+	p.producers.Wait()
+	close(p.tasks)
+	log.Printf("Draining %d queued events\n", len(p.tasks))
+
+	drained := make(chan struct{})
+	go func() {
+		p.dispatcher.Wait()
+		p.persist.workers.Wait()
+		p.notify.workers.Wait()
+		p.retries.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Println("Shutdown deadline reached, abandoning queued events")
+		// Workers finish the event they are working on before they stop,
+		// deliveries that are still retrying become dead letters
+		p.cancel()
+		<-drained
+	}
+
+	log.Printf("Pipeline stopped, flushed %d events, abandoned %d events\n",
+		atomic.LoadInt64(&p.processed)-processed, atomic.LoadInt64(&p.abandoned))
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitPayloadSingleEvent(t *testing.T) {
+	payload := []byte("{\n  \"application\": \"app\",\n  \"identifier\": \"signup\"\n}\n")
+	lines := splitPayload(payload)
+
+	assert.Equal(t, 1, len(lines))
+	assert.Equal(t, 1, lines[0].number)
+}
+
+func TestSplitPayloadBatch(t *testing.T) {
+	payload := []byte("{\"identifier\": \"a\"}\n\n{\"identifier\": \"b\"}\n{broken\n")
+	lines := splitPayload(payload)
+
+	assert.Equal(t, 3, len(lines))
+	assert.Equal(t, 1, lines[0].number)
+	assert.Equal(t, 3, lines[1].number)
+	assert.Equal(t, 4, lines[2].number)
+	assert.Equal(t, []byte("{broken"), lines[2].data)
+}
+
+func TestSplitPayloadEmpty(t *testing.T) {
+	assert.Equal(t, 0, len(splitPayload([]byte(" \n"))))
+}
+
+func TestWorkerPool(t *testing.T) {
+	wp := newWorkerPool("test", 2, 10)
+	processed := make(chan string, 3)
+	wp.start(make(chan struct{}), func(e Event) error {
+		processed <- e.Identifier
+		return nil
+	}, func(e Event, err error, abandoned bool) {})
+
+	for _, id := range []string{"a", "b", "c"} {
+		wp.tasks <- Event{Identifier: id}
+	}
+	close(wp.tasks)
+	wp.workers.Wait()
+
+	assert.Equal(t, 3, len(processed))
+	stats := wp.stats()
+	assert.Equal(t, "test", stats.Name)
+	assert.Equal(t, 20, stats.QueueCapacity)
+	assert.Equal(t, 2, stats.Workers)
+	assert.Equal(t, int64(0), stats.BusyWorkers)
+}
+
+func TestStageDoneWaitsForAllStages(t *testing.T) {
+	p := &pipeline{}
+	e := Event{stages: &stages{remaining: 2}}
+
+	p.stageDone(e, nil, false)
+	assert.Equal(t, int64(0), p.processed)
+
+	p.stageDone(e, errors.New("persist failed"), false)
+	assert.Equal(t, int64(1), p.processed)
+	assert.Equal(t, int64(0), p.abandoned)
+}
+
+func TestWorkerPoolRecoversPanic(t *testing.T) {
+	wp := newWorkerPool("test", 1, 1)
+	errs := make(chan error, 1)
+	wp.start(make(chan struct{}), func(e Event) error {
+		panic("boom")
+	}, func(e Event, err error, abandoned bool) {
+		errs <- err
+	})
+
+	wp.tasks <- Event{}
+	close(wp.tasks)
+	wp.workers.Wait()
+
+	assert.Equal(t, "panic in test worker: boom", (<-errs).Error())
+}
+
+func TestStalledNotifyDoesNotHoldBackPersist(t *testing.T) {
+	p := &pipeline{
+		tasks:   make(chan Event, 10),
+		persist: newWorkerPool("persist", 1, 2),
+		notify:  newWorkerPool("notify", 1, 10),
+		abandon: make(chan struct{}),
+	}
+	persisted := make(chan string, 20)
+	release := make(chan struct{})
+	p.persist.start(p.abandon, func(e Event) error {
+		persisted <- e.Identifier
+		return nil
+	}, p.stageDone)
+	p.notify.start(p.abandon, func(e Event) error {
+		<-release
+		return nil
+	}, p.stageDone)
+	p.dispatch()
+
+	for i := 0; i < 20; i++ {
+		p.tasks <- Event{Identifier: fmt.Sprintf("event-%d", i)}
+	}
+	for i := 0; i < 20; i++ {
+		select {
+		case id := <-persisted:
+			assert.Equal(t, fmt.Sprintf("event-%d", i), id)
+		case <-time.After(time.Second):
+			t.Fatalf("persisted %d of 20 events while notify was stalled", i)
+		}
+	}
+	assert.True(t, p.notify.stats().Backlog > 0)
+
+	close(release)
+	close(p.tasks)
+	p.dispatcher.Wait()
+	p.persist.workers.Wait()
+	p.notify.workers.Wait()
+	assert.Equal(t, int64(20), p.processed)
+}
+
+func TestStalledStageRejectsEvents(t *testing.T) {
+	p := &pipeline{
+		incoming:    make(chan incomingItem),
+		tasks:       make(chan Event, 2),
+		persist:     newWorkerPool("persist", 1, 2),
+		notify:      newWorkerPool("notify", 1, 2),
+		idGenerator: make(chan string),
+		quit:        make(chan struct{}),
+		abandon:     make(chan struct{}),
+	}
+	go func() {
+		for i := 0; ; i++ {
+			select {
+			case p.idGenerator <- fmt.Sprintf("id-%d", i):
+			case <-p.quit:
+				return
+			}
+		}
+	}()
+	release := make(chan struct{})
+	p.persist.start(p.abandon, func(e Event) error { return nil }, p.stageDone)
+	p.notify.start(p.abandon, func(e Event) error {
+		<-release
+		return nil
+	}, p.stageDone)
+	p.dispatch()
+	p.receive()
+
+	events := handleEvents(p.incoming)
+	post := func() int {
+		request, _ := http.NewRequest("POST", "/v1/events", strings.NewReader(`{"application": "app", "identifier": "signup"}`))
+		response := httptest.NewRecorder()
+		events.ServeHTTP(response, request)
+		return response.Code
+	}
+
+	// One event is being notified about and one waits to be queued by feed,
+	// then the queue and backlog of notify, the event held by dispatch and the
+	// tasks buffer fill up
+	accepted := 0
+	for post() == http.StatusAccepted {
+		accepted++
+		if accepted > 100 {
+			t.Fatal("stalled notify stage did not fill up")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, http.StatusTooManyRequests, post())
+	assert.True(t, accepted <= 9)
+	assert.NotNil(t, p.saturated(0.9))
+
+	close(release)
+	close(p.quit)
+	p.producers.Wait()
+	close(p.tasks)
+	p.dispatcher.Wait()
+	p.persist.workers.Wait()
+	p.notify.workers.Wait()
+	assert.Equal(t, int64(accepted), p.processed)
+	assert.Nil(t, p.saturated(0.9))
+}
+
+func TestReplayedEventsAreNotNotifiedAgain(t *testing.T) {
+	p := &pipeline{
+		tasks:   make(chan Event, 10),
+		persist: newWorkerPool("persist", 1, 10),
+		notify:  newWorkerPool("notify", 1, 10),
+		abandon: make(chan struct{}),
+	}
+	persisted := make(chan string, 2)
+	notified := make(chan string, 2)
+	p.persist.start(p.abandon, func(e Event) error {
+		persisted <- e.Identifier
+		return nil
+	}, p.persistDone)
+	p.notify.start(p.abandon, func(e Event) error {
+		notified <- e.Identifier
+		return nil
+	}, p.notifyDone)
+	p.dispatch()
+
+	p.tasks <- Event{Identifier: "new"}
+	p.tasks <- Event{Identifier: "replayed", notified: true}
+	close(p.tasks)
+	p.dispatcher.Wait()
+	p.persist.workers.Wait()
+	p.notify.workers.Wait()
+
+	assert.Equal(t, 2, len(persisted))
+	assert.Equal(t, 1, len(notified))
+	assert.Equal(t, "new", <-notified)
+	assert.Equal(t, int64(2), p.processed)
+}
+
+func TestFailedPersistIsRetried(t *testing.T) {
+	defer func(retries int) { C.PersistRetries = retries }(C.PersistRetries)
+	C.PersistRetries = 3
+
+	p := &pipeline{
+		tasks:   make(chan Event, 10),
+		persist: newWorkerPool("persist", 1, 10),
+		notify:  newWorkerPool("notify", 1, 10),
+		quit:    make(chan struct{}),
+		abandon: make(chan struct{}),
+	}
+	attempts := int32(0)
+	persisted := make(chan struct{})
+	p.persist.start(p.abandon, func(e Event) error {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			return errors.New("connection refused")
+		}
+		close(persisted)
+		return nil
+	}, p.persistDone)
+	p.notify.start(p.abandon, func(e Event) error { return nil }, p.notifyDone)
+	p.dispatch()
+
+	p.tasks <- Event{Identifier: "signup"}
+	select {
+	case <-persisted:
+	case <-time.After(time.Second):
+		t.Fatal("event was not persisted after retrying")
+	}
+	assert.Equal(t, int32(3), atomic.LoadInt32(&attempts))
+
+	close(p.quit)
+	close(p.tasks)
+	p.dispatcher.Wait()
+	p.persist.workers.Wait()
+	p.notify.workers.Wait()
+	p.retries.Wait()
+	assert.Equal(t, int64(1), p.processed)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// route is a handler for a method and a path like /v1/notifiers/{id}, the
+// values of segments in braces are available through PathValue
+type route struct {
+	method   string
+	segments []string
+	handler  http.Handler
+}
+
+// router matches requests against its routes by hand. We build in GOPATH
+// mode, where http.ServeMux does not understand methods and wildcards in its
+// patterns.
+type router struct {
+	routes []route
+}
+
+func splitPath(path string) []string {
+	return strings.Split(strings.Trim(path, "/"), "/")
+}
+
+// handle adds a route, routes are matched in the order they were added
+func (rt *router) handle(method string, pattern string, handler http.Handler) {
+	rt.routes = append(rt.routes, route{method, splitPath(pattern), handler})
+}
+
+// register sends the requests for all routes from mux to the router
+func (rt *router) register(mux *http.ServeMux) {
+	registered := map[string]bool{}
+	for _, route := range rt.routes {
+		pattern := "/" + strings.Join(route.segments[:2], "/")
+		if len(route.segments) > 2 {
+			pattern += "/"
+		}
+		if !registered[pattern] {
+			mux.Handle(pattern, rt)
+			registered[pattern] = true
+		}
+	}
+}
+
+// match returns the values of the wildcards when path matches the route
+func (r route) match(path []string) (map[string]string, bool) {
+	if len(path) != len(r.segments) {
+		return nil, false
+	}
+	values := map[string]string{}
+	for i, segment := range r.segments {
+		if strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+			values[segment[1:len(segment)-1]] = path[i]
+			continue
+		}
+		if segment != path[i] {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func (rt *router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := splitPath(r.URL.Path)
+	allowed := []string{}
+	for _, route := range rt.routes {
+		values, ok := route.match(path)
+		if !ok {
+			continue
+		}
+		if route.method != r.Method {
+			allowed = append(allowed, route.method)
+			continue
+		}
+		for name, value := range values {
+			r.SetPathValue(name, value)
+		}
+		route.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// registerRoutes adds our REST API to mux, the dead letter and delivery log
+// endpoints need Postgres
+func registerRoutes(mux *http.ServeMux, withDB bool) {
+	api := &router{}
+	api.handle("GET", "/v1/notifiers", handleNotifiers())
+	api.handle("POST", "/v1/notifiers", handleCreateNotifier())
+	api.handle("GET", "/v1/notifiers/{id}", handleNotifier())
+	api.handle("PUT", "/v1/notifiers/{id}", handleUpdateNotifier())
+	api.handle("DELETE", "/v1/notifiers/{id}", handleDeleteNotifier())
+	api.handle("POST", "/v1/notifiers/{id}/snooze", handleSnoozeNotifier())
+	api.handle("POST", "/v1/notifiers/{id}/resume", handleResumeNotifier())
+	if withDB {
+		api.handle("GET", "/v1/dead_letters", handleDeadLetters())
+		api.handle("POST", "/v1/dead_letters/redrive", handleRedriveAll())
+		api.handle("GET", "/v1/dead_letters/{id}", handleDeadLetter())
+		api.handle("POST", "/v1/dead_letters/{id}/redrive", handleRedrive())
+		api.handle("GET", "/v1/notifiers/{id}/deliveries", handleNotifierDeliveries())
+		api.handle("GET", "/v1/events/{requestID}/deliveries", handleEventDeliveries())
+	}
+	api.register(mux)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func echoRoute(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", name, r.PathValue("id"))
+	})
+}
+
+func TestRouter(t *testing.T) {
+	api := &router{}
+	api.handle("GET", "/v1/things", echoRoute("list"))
+	api.handle("POST", "/v1/things/redrive", echoRoute("redrive"))
+	api.handle("GET", "/v1/things/{id}", echoRoute("get"))
+	api.handle("DELETE", "/v1/things/{id}", echoRoute("delete"))
+	mux := http.NewServeMux()
+	api.register(mux)
+
+	cases := []struct {
+		method string
+		path   string
+		code   int
+		body   string
+	}{
+		{"GET", "/v1/things", http.StatusOK, "list "},
+		{"POST", "/v1/things/redrive", http.StatusOK, "redrive "},
+		{"GET", "/v1/things/3", http.StatusOK, "get 3"},
+		{"DELETE", "/v1/things/3", http.StatusOK, "delete 3"},
+		{"PUT", "/v1/things/3", http.StatusMethodNotAllowed, "method not allowed\n"},
+		{"GET", "/v1/things/3/other", http.StatusNotFound, "404 page not found\n"},
+		{"GET", "/v1/others", http.StatusNotFound, "404 page not found\n"},
+	}
+	for _, c := range cases {
+		request, _ := http.NewRequest(c.method, c.path, nil)
+		response := httptest.NewRecorder()
+		mux.ServeHTTP(response, request)
+		assert.Equal(t, c.code, response.Code, c.method+" "+c.path)
+		assert.Equal(t, c.body, response.Body.String(), c.method+" "+c.path)
+	}
+}
+
+func TestDeadLetterRoutesNeedDB(t *testing.T) {
+	mux := http.NewServeMux()
+	registerRoutes(mux, false)
+
+	request, _ := http.NewRequest("GET", "/v1/dead_letters", nil)
+	response := httptest.NewRecorder()
+	mux.ServeHTTP(response, request)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
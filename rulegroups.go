@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/jmoiron/sqlx/types"
+	"gopkg.in/yaml.v3"
+)
+
+// Operators of rule groups
+const (
+	ruleAll  = "all"
+	ruleAny  = "any"
+	ruleNone = "none"
+)
+
+// ruleTree is either a single rule or a group of rule trees, a group is met
+// when all, any or none of its children are. A plain array of rules, like
+// notifiers have always used, is an implicit all group.
+type ruleTree struct {
+	op       string
+	rule     *rule
+	children []*ruleTree
+	implicit bool
+}
+
+// noRules is met by every event
+func noRules() *ruleTree {
+	return &ruleTree{op: ruleAll, implicit: true}
+}
+
+// isEmptyRules returns whether raw holds no rules at all, empty JSONText is
+// stored as {}
+func isEmptyRules(raw []byte) bool {
+	trimmed := bytes.TrimSpace(raw)
+	return len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) || bytes.Equal(trimmed, []byte("{}"))
+}
+
+// parseRules strictly decodes rules, unlike loadRules it fails on rules we
+// would not be able to check
+func parseRules(raw types.JSONText) (*ruleTree, error) {
+	if isEmptyRules(raw) {
+		return noRules(), nil
+	}
+
+	tree := &ruleTree{}
+	err := json.Unmarshal(raw, tree)
+	if err != nil {
+		return nil, err
+	}
+	err = tree.validate()
+	if err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// loadRules parses the rules of a notifier to be checked against events. A
+// plain list of rules written before they were validated is loaded leniently,
+// ignoring fields we do not know. Anything else that does not parse is an
+// error, so a notifier never fires on rules it can not check.
+func loadRules(raw types.JSONText) (*ruleTree, error) {
+	tree, err := parseRules(raw)
+	if err != nil {
+		if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			return nil, err
+		}
+		rules := []*rule{}
+		if json.Unmarshal(raw, &rules) != nil {
+			return nil, err
+		}
+		tree = noRules()
+		for _, r := range rules {
+			tree.children = append(tree.children, &ruleTree{rule: r})
+		}
+	}
+	tree.compile()
+	return tree, nil
+}
+
+// compiledRules is a loaded rule tree together with the source it was loaded
+// from, so we know when it has to be loaded again
+type compiledRules struct {
+	source string
+	tree   *ruleTree
+	err    error
+}
+
+// ruleCache keeps the loaded rules of every notifier between reloads, rules
+// are only loaded again when their source changes
+type ruleCache struct {
+	mu    sync.Mutex
+	rules map[int]compiledRules
+}
+
+// ruleTrees is shared by all notifier cache reloads
+var ruleTrees = newRuleCache()
+
+func newRuleCache() *ruleCache {
+	return &ruleCache{rules: map[int]compiledRules{}}
+}
+
+// get returns the loaded rules of a notifier. fresh is true when the source
+// was loaded by this call, so callers can report bad rules only once.
+func (rc *ruleCache) get(id int, source types.JSONText) (cr compiledRules, fresh bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	cr, ok := rc.rules[id]
+	if ok && cr.source == string(source) {
+		return cr, false
+	}
+
+	tree, err := loadRules(source)
+	cr = compiledRules{source: string(source), tree: tree, err: err}
+	rc.rules[id] = cr
+	return cr, true
+}
+
+// retain drops the rules of notifiers that no longer exist
+func (rc *ruleCache) retain(ids map[int]bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for id := range rc.rules {
+		if !ids[id] {
+			delete(rc.rules, id)
+		}
+	}
+}
+
+func (t *ruleTree) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		t.op, t.implicit = ruleAll, true
+		return json.Unmarshal(data, &t.children)
+	}
+
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(data, &fields)
+	if err != nil {
+		return err
+	}
+	if len(fields) == 1 {
+		for op, children := range fields {
+			if op == ruleAll || op == ruleAny || op == ruleNone {
+				t.op = op
+				return json.Unmarshal(children, &t.children)
+			}
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	t.rule = &rule{}
+	return decoder.Decode(t.rule)
+}
+
+func (t *ruleTree) UnmarshalYAML(node *yaml.Node) error {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		t.op, t.implicit = ruleAll, true
+		return node.Decode(&t.children)
+	case yaml.MappingNode:
+		if len(node.Content) == 2 {
+			op := node.Content[0].Value
+			if op == ruleAll || op == ruleAny || op == ruleNone {
+				t.op = op
+				return node.Content[1].Decode(&t.children)
+			}
+		}
+		for i := 0; i < len(node.Content); i += 2 {
+			switch field := node.Content[i]; field.Value {
+			case "key", "type", "setting", "value", "values", "time_zone":
+			default:
+				return fmt.Errorf("line %d: unknown field %q in rule", field.Line, field.Value)
+			}
+		}
+		t.rule = &rule{}
+		return node.Decode(t.rule)
+	}
+	return fmt.Errorf("line %d: rules must be a list or a mapping", node.Line)
+}
+
+func (t *ruleTree) MarshalJSON() ([]byte, error) {
+	if t.rule != nil {
+		return json.Marshal(t.rule)
+	}
+
+	children := t.children
+	if children == nil {
+		children = []*ruleTree{}
+	}
+	if t.implicit {
+		return json.Marshal(children)
+	}
+	return json.Marshal(map[string][]*ruleTree{t.op: children})
+}
+
+// validate checks every rule in the tree, explicit groups need at least one
+// child
+func (t *ruleTree) validate() error {
+	if t.rule != nil {
+		return t.rule.validate()
+	}
+	if len(t.children) == 0 && !t.implicit {
+		return fmt.Errorf("%s group is empty", t.op)
+	}
+
+	for i, child := range t.children {
+		if child == nil {
+			return fmt.Errorf("%s[%d] is empty", t.op, i)
+		}
+		err := child.validate()
+		if err != nil {
+			return fmt.Errorf("%s[%d]: %s", t.op, i, err)
+		}
+	}
+	return nil
+}
+
+// compile prepares every rule in the tree, see rule.compile
+func (t *ruleTree) compile() {
+	if t.rule != nil {
+		t.rule.compile()
+	}
+	for _, child := range t.children {
+		if child != nil {
+			child.compile()
+		}
+	}
+}
+
+// evaluate returns whether the event meets the tree, and if not which branch
+// failed. Branches of explicit groups are named like all[1] > any(...).
+func (t *ruleTree) evaluate(e *Event) (bool, string, error) {
+	if t.rule != nil {
+		met, reason, err := t.rule.check(e)
+		if err != nil || !met {
+			failed := t.rule.String()
+			if reason != "" {
+				failed = fmt.Sprintf("%s (%s)", failed, reason)
+			}
+			return false, failed, err
+		}
+		return true, "", nil
+	}
+
+	switch t.op {
+	case ruleAny:
+		for _, child := range t.children {
+			if child == nil {
+				continue
+			}
+			met, failed, err := child.evaluate(e)
+			if err != nil {
+				return false, failed, err
+			}
+			if met {
+				return true, "", nil
+			}
+		}
+		return false, fmt.Sprintf("%s not met", t), nil
+	case ruleNone:
+		for i, child := range t.children {
+			if child == nil {
+				continue
+			}
+			met, failed, err := child.evaluate(e)
+			if err != nil {
+				return false, failed, err
+			}
+			if met {
+				return false, fmt.Sprintf("none[%d] > %s is met", i, child), nil
+			}
+		}
+		return true, "", nil
+	}
+
+	for i, child := range t.children {
+		if child == nil {
+			continue
+		}
+		met, failed, err := child.evaluate(e)
+		if err != nil || !met {
+			if !t.implicit {
+				failed = fmt.Sprintf("all[%d] > %s", i, failed)
+			}
+			return false, failed, err
+		}
+	}
+	return true, "", nil
+}
+
+// String describes the tree for logs and the delivery log
+func (t *ruleTree) String() string {
+	if t.rule != nil {
+		return t.rule.String()
+	}
+
+	children := make([]string, 0, len(t.children))
+	for _, child := range t.children {
+		if child != nil {
+			children = append(children, child.String())
+		}
+	}
+	return fmt.Sprintf("%s(%s)", t.op, strings.Join(children, ", "))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/assert"
+	"gopkg.in/yaml.v3"
+)
+
+func evaluateTestRules(t *testing.T, rules string, data string) (bool, string) {
+	tree, err := parseRules(types.JSONText(rules))
+	assert.Nil(t, err)
+	event := setupTestNotifier(types.JSONText(data))
+	met, failed, err := tree.evaluate(&event)
+	assert.Nil(t, err)
+	return met, failed
+}
+
+func TestRuleGroupAny(t *testing.T) {
+	rules := `{"any": [{"key": "plan", "type": "string", "value": "enterprise"}, {"key": "revenue", "type": "number", "setting": "gt", "value": "1000"}]}`
+
+	met, _ := evaluateTestRules(t, rules, `{"plan": "enterprise", "revenue": 10}`)
+	assert.True(t, met)
+	met, _ = evaluateTestRules(t, rules, `{"plan": "basic", "revenue": 2000}`)
+	assert.True(t, met)
+	met, failed := evaluateTestRules(t, rules, `{"plan": "basic", "revenue": 10}`)
+	assert.False(t, met)
+	assert.Equal(t, `any(plan string  "enterprise", revenue number gt "1000") not met`, failed)
+}
+
+func TestRuleGroupNone(t *testing.T) {
+	rules := `{"none": [{"key": "test", "type": "boolean", "value": "true"}]}`
+
+	met, _ := evaluateTestRules(t, rules, `{"test": false}`)
+	assert.True(t, met)
+	met, failed := evaluateTestRules(t, rules, `{"test": true}`)
+	assert.False(t, met)
+	assert.Equal(t, `none[0] > test boolean  "true" is met`, failed)
+}
+
+func TestRuleGroupNested(t *testing.T) {
+	rules := `[
+		{"key": "active", "type": "boolean", "value": "true"},
+		{"all": [
+			{"key": "country", "type": "string", "value": "NL"},
+			{"any": [{"key": "plan", "type": "string", "value": "enterprise"}, {"key": "seats", "type": "number", "setting": "gt", "value": "50"}]}
+		]}
+	]`
+
+	met, _ := evaluateTestRules(t, rules, `{"active": true, "country": "NL", "plan": "basic", "seats": 100}`)
+	assert.True(t, met)
+
+	met, failed := evaluateTestRules(t, rules, `{"active": true, "country": "NL", "plan": "basic", "seats": 10}`)
+	assert.False(t, met)
+	assert.Equal(t, `all[1] > any(plan string  "enterprise", seats number gt "50") not met`, failed)
+
+	// Failures of the implicit top level group are reported as before
+	met, failed = evaluateTestRules(t, rules, `{"active": false}`)
+	assert.False(t, met)
+	assert.Equal(t, `active boolean  "true"`, failed)
+}
+
+func TestParseRuleGroupsInvalid(t *testing.T) {
+	invalid := []string{
+		`{"any": []}`,
+		`{"any": [null]}`,
+		`{"any": [{"key": "plan", "type": "text"}]}`,
+		`{"any": [{"key": "plan", "type": "string", "value": "x", "extra": true}]}`,
+		`{"maybe": [{"key": "plan", "type": "string"}]}`,
+	}
+	for _, raw := range invalid {
+		_, err := parseRules(types.JSONText(raw))
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestRuleGroupsYAML(t *testing.T) {
+	var tree ruleTree
+	err := yaml.Unmarshal([]byte(`
+any:
+  - key: plan
+    type: string
+    value: enterprise
+  - key: revenue
+    type: number
+    setting: gt
+    value: 1000
+`), &tree)
+	assert.Nil(t, err)
+	assert.Nil(t, tree.validate())
+
+	encoded, err := tree.MarshalJSON()
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{"any": [{"key": "plan", "type": "string", "setting": "", "value": "enterprise"}, {"key": "revenue", "type": "number", "setting": "gt", "value": "1000"}]}`, string(encoded))
+
+	err = yaml.Unmarshal([]byte("key: plan\ntype: string\noptions: [a]\n"), &ruleTree{})
+	assert.NotNil(t, err)
+}
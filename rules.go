@@ -2,8 +2,11 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"fmt"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type rule struct {
@@ -11,92 +14,321 @@ type rule struct {
 	Type    string `json:"type"`
 	Setting string `json:"setting"`
 	Value   string `json:"value"`
+	// Values is used by settings that compare against more than one value,
+	// like in and between
+	Values []string `json:"values,omitempty"`
+	// TimeZone is used by datetime rules that check the time of day or the
+	// day of the week, RuleTimeZone when empty
+	TimeZone string `json:"time_zone,omitempty"`
+
+	// regex is compiled once when the rules are loaded, and so is location
+	regex    *regexp.Regexp
+	location *time.Location
+}
+
+// ruleSettings lists the settings every rule type supports
+var ruleSettings = map[string][]string{
+	"boolean":  {"", "eq", "noteq"},
+	"string":   {"", "eq", "noteq", "ieq", "in", "notin", "contains", "starts_with", "ends_with", "regex"},
+	"number":   {"eq", "noteq", "gt", "gte", "lt", "lte", "between"},
+	"array":    {"contains", "length", "length_gt", "length_lt"},
+	"datetime": {"before", "after", "within_last", "within_next", "time_between", "weekday_in"},
+}
+
+// validate checks that the type, setting and value of a rule make sense
+func (r *rule) validate() error {
+	if r.Key == "" {
+		return fmt.Errorf("key is required")
+	}
+	_, err := parseKeyPath(r.Key)
+	if err != nil {
+		return err
+	}
+
+	settings, ok := ruleSettings[r.Type]
+	if !ok {
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	known := false
+	for _, s := range settings {
+		if s == r.Setting {
+			known = true
+		}
+	}
+	if !known {
+		return fmt.Errorf("unknown setting %q for type %s", r.Setting, r.Type)
+	}
+
+	switch r.Type {
+	case "boolean":
+		_, err := strconv.ParseBool(r.Value)
+		if err != nil {
+			return fmt.Errorf("value %q is not a boolean", r.Value)
+		}
+	case "string":
+		return r.validateString()
+	case "number":
+		return r.validateNumber()
+	case "datetime":
+		return r.validateDatetime()
+	case "array":
+		if strings.HasPrefix(r.Setting, "length") {
+			_, err := strconv.Atoi(r.Value)
+			if err != nil {
+				return fmt.Errorf("value %q is not a length", r.Value)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *rule) validateString() error {
+	switch r.Setting {
+	case "in", "notin":
+		if len(r.Values) == 0 {
+			return fmt.Errorf("%s needs values", r.Setting)
+		}
+	case "regex":
+		_, err := regexp.Compile(r.Value)
+		if err != nil {
+			return fmt.Errorf("invalid regex: %s", err)
+		}
+	}
+	return nil
+}
+
+func (r *rule) validateNumber() error {
+	if r.Setting != "between" {
+		_, err := strconv.ParseFloat(r.Value, 64)
+		if err != nil {
+			return fmt.Errorf("value %q is not a number", r.Value)
+		}
+		return nil
+	}
+
+	if len(r.Values) != 2 {
+		return fmt.Errorf("between needs two values")
+	}
+	bounds := [2]float64{}
+	for i, v := range r.Values {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("value %q is not a number", v)
+		}
+		bounds[i] = f
+	}
+	if bounds[0] > bounds[1] {
+		return fmt.Errorf("between needs the lowest value first")
+	}
+	return nil
 }
 
+// compile prepares the rule to be checked against events, a regex that
+// does not compile never matches
+func (r *rule) compile() {
+	if r.Type == "string" && r.Setting == "regex" {
+		r.regex, _ = regexp.Compile(r.Value)
+	}
+	if r.Type == "datetime" {
+		r.location, _ = r.timeZone()
+	}
+}
+
+// String describes the rule for logs and the delivery log
+func (r *rule) String() string {
+	if len(r.Values) > 0 {
+		return fmt.Sprintf("%s %s %s %q", r.Key, r.Type, r.Setting, r.Values)
+	}
+	return fmt.Sprintf("%s %s %s %q", r.Key, r.Type, r.Setting, r.Value)
+}
+
+// Met returns whether the event satisfies the rule, an event we can not
+// decode never does
 func (r *rule) Met(e *Event) bool {
+	met, reason, err := r.check(e)
+	if err != nil {
+		e.log("[NOTIFY] Could not check rule %s: %s", r.Key, err)
+	}
+	if reason != "" {
+		e.log("[NOTIFY] Rule %s not met: %s", r.Key, reason)
+	}
+	return met
+}
+
+func (r *rule) met(e *Event) (bool, error) {
+	met, _, err := r.check(e)
+	return met, err
+}
+
+// check returns whether the event satisfies the rule. When it does not because
+// the value in the event has the wrong type, reason says why.
+func (r *rule) check(e *Event) (met bool, reason string, err error) {
 	var parsed map[string]interface{}
-	err := json.Unmarshal([]byte(e.Data), &parsed)
+	err = json.Unmarshal([]byte(e.Data), &parsed)
 	if err != nil {
-		log.Fatal("json.Unmarshal", err)
+		return false, "", fmt.Errorf("invalid event data: %s", err)
 	}
 
-	// check if key is in the map
-	// first value is actual value of key in the map
-	if _, ok := parsed[r.Key]; !ok {
-		return false
+	// Key is a path into the data, a path with wildcards is met when any of
+	// its values is
+	values, found := lookupPath(parsed, r.Key)
+	if r.Key == receivedKey {
+		values, found = []interface{}{e.receivedTime()}, true
+	}
+	if !found {
+		return false, "", nil
 	}
 
-	// if key is present but nil
-	if parsed[r.Key] == nil {
-		if r.Setting == "noteq" {
-			return true
+	var mismatch error
+	for _, val := range values {
+		met, err := r.metValue(val)
+		if err != nil {
+			mismatch = err
+			continue
 		}
+		if met {
+			return true, "", nil
+		}
+	}
+	if mismatch != nil {
+		return false, mismatch.Error(), nil
+	}
+	return false, "", nil
+}
 
-		return false
+// metValue returns a typeMismatch when val can not be coerced into the type
+// of the rule
+func (r *rule) metValue(val interface{}) (bool, error) {
+	// if key is present but nil
+	if val == nil {
+		return r.Setting == "noteq", nil
 	}
 
 	switch r.Type {
 	case "boolean":
-		return metBool(r, parsed)
+		return metBool(r, val)
 	case "string":
-		return metString(r, parsed)
+		return metString(r, val)
 	case "number":
-		return metNumber(r, parsed)
+		return metNumber(r, val)
+	case "array":
+		return metArray(r, val)
+	case "datetime":
+		return metDatetime(r, val)
 	}
 
-	return true
+	return true, nil
 }
 
-func metBool(r *rule, parsed map[string]interface{}) bool {
-	val := parsed[r.Key]
-	neededVal, _ := strconv.ParseBool(r.Value)
-	if val.(bool) != neededVal {
-		return false
+func metBool(r *rule, value interface{}) (bool, error) {
+	val, err := coerceBool(value)
+	if err != nil {
+		return false, err
 	}
 
-	return true
+	neededVal, _ := strconv.ParseBool(r.Value)
+	if r.Setting == "noteq" {
+		return val != neededVal, nil
+	}
+	return val == neededVal, nil
 }
 
-func metString(r *rule, parsed map[string]interface{}) bool {
-	val := parsed[r.Key]
+func metString(r *rule, value interface{}) (bool, error) {
+	str, err := coerceString(value)
+	if err != nil {
+		return false, err
+	}
 	neededVal := r.Value
 
-	str := val.(string)
-
-	if r.Setting == "noteq" {
-		if str == neededVal {
-			// We need not equal and string is equal
-			return false
-		}
-		// We need not equal and string is not equal
-		return true
+	switch r.Setting {
+	case "noteq":
+		return str != neededVal, nil
+	case "ieq":
+		return strings.EqualFold(str, neededVal), nil
+	case "in":
+		return containsString(r.Values, str), nil
+	case "notin":
+		return !containsString(r.Values, str), nil
+	case "contains":
+		return strings.Contains(str, neededVal), nil
+	case "starts_with":
+		return strings.HasPrefix(str, neededVal), nil
+	case "ends_with":
+		return strings.HasSuffix(str, neededVal), nil
+	case "regex":
+		return r.regex != nil && r.regex.MatchString(str), nil
 	}
 
-	if str != neededVal {
-		return false
-	}
+	return str == neededVal, nil
+}
 
-	return true
+func containsString(values []string, str string) bool {
+	for _, v := range values {
+		if v == str {
+			return true
+		}
+	}
+	return false
 }
 
-func metNumber(r *rule, parsed map[string]interface{}) bool {
-	val := parsed[r.Key].(float64)
+func metNumber(r *rule, value interface{}) (bool, error) {
+	val, err := coerceNumber(value)
+	if err != nil {
+		return false, err
+	}
 	neededVal, _ := strconv.ParseFloat(r.Value, 64)
 
 	switch r.Setting {
 	case "eq":
-		if val != neededVal {
-			return false
-		}
+		return val == neededVal, nil
+	case "noteq":
+		return val != neededVal, nil
 	case "gt":
-		if val <= neededVal {
-			return false
-		}
+		return val > neededVal, nil
+	case "gte":
+		return val >= neededVal, nil
 	case "lt":
-		if val >= neededVal {
-			return false
+		return val < neededVal, nil
+	case "lte":
+		return val <= neededVal, nil
+	case "between":
+		if len(r.Values) != 2 {
+			return false, nil
+		}
+		min, _ := strconv.ParseFloat(r.Values[0], 64)
+		max, _ := strconv.ParseFloat(r.Values[1], 64)
+		return val >= min && val <= max, nil
+	}
+
+	return true, nil
+}
+
+// metArray checks arrays, contains compares the items as they are written in
+// JSON, so "12" matches both 12 and "12"
+func metArray(r *rule, value interface{}) (bool, error) {
+	items, err := coerceArray(value)
+	if err != nil {
+		return false, err
+	}
+
+	switch r.Setting {
+	case "contains":
+		for _, item := range items {
+			if fmt.Sprint(item) == r.Value {
+				return true, nil
+			}
+		}
+		return false, nil
+	case "length", "length_gt", "length_lt":
+		length, _ := strconv.Atoi(r.Value)
+		switch r.Setting {
+		case "length_gt":
+			return len(items) > length, nil
+		case "length_lt":
+			return len(items) < length, nil
 		}
+		return len(items) == length, nil
 	}
 
-	return true
+	return true, nil
 }
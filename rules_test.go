@@ -250,3 +250,135 @@ func TestNumberLt(t *testing.T) {
 	result := r.Met(&event)
 	assert.Equal(t, true, result)
 }
+
+func TestParseRules(t *testing.T) {
+	rules, err := parseRules(types.JSONText(`[{"key": "active", "type": "boolean", "value": "true"}, {"key": "number", "type": "number", "setting": "gt", "value": "10"}]`))
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(rules.children))
+
+	invalid := []string{
+		`{"key": "name"}`,
+		`[{"key": "name", "type": "string", "value": "Go", "extra": 1}]`,
+		`[{"type": "string", "value": "Go"}]`,
+		`[{"key": "name", "type": "date", "value": "Go"}]`,
+		`[{"key": "number", "type": "number", "setting": "around", "value": "10"}]`,
+		`[{"key": "number", "type": "number", "setting": "gt", "value": "ten"}]`,
+		`[{"key": "active", "type": "boolean", "value": "yes"}]`,
+		`[null]`,
+	}
+	for _, raw := range invalid {
+		_, err := parseRules(types.JSONText(raw))
+		assert.NotNil(t, err, raw)
+	}
+}
+
+var nestedData = types.JSONText(`{"user": {"company": {"plan": "pro"}}, "order": {"items": [{"sku": "A1", "price": 50}, {"sku": "B2", "price": 150}]}}`)
+
+func TestNestedKeyMatch(t *testing.T) {
+	event := setupTestNotifier(nestedData)
+
+	r := rule{Key: "user.company.plan", Type: "string", Value: "pro"}
+	assert.Equal(t, true, r.Met(&event))
+
+	r = rule{Key: "order.items[0].sku", Type: "string", Value: "B2"}
+	assert.Equal(t, false, r.Met(&event))
+}
+
+func TestWildcardKeyMatchesAnyItem(t *testing.T) {
+	event := setupTestNotifier(nestedData)
+
+	r := rule{Key: "order.items[*].price", Type: "number", Setting: "gt", Value: "100"}
+	assert.Equal(t, true, r.Met(&event))
+
+	r = rule{Key: "order.items[*].price", Type: "number", Setting: "gt", Value: "200"}
+	assert.Equal(t, false, r.Met(&event))
+}
+
+func TestParseRulesOperators(t *testing.T) {
+	valid := []string{
+		`[{"key": "number", "type": "number", "setting": "between", "values": ["10", "20"]}]`,
+		`[{"key": "name", "type": "string", "setting": "in", "values": ["Go", "Rust"]}]`,
+		`[{"key": "name", "type": "string", "setting": "regex", "value": "^G"}]`,
+		`[{"key": "tags", "type": "array", "setting": "length_gt", "value": "1"}]`,
+	}
+	for _, raw := range valid {
+		_, err := parseRules(types.JSONText(raw))
+		assert.Nil(t, err, raw)
+	}
+
+	invalid := []string{
+		`[{"key": "number", "type": "number", "setting": "between", "values": ["20", "10"]}]`,
+		`[{"key": "number", "type": "number", "setting": "between", "value": "10"}]`,
+		`[{"key": "name", "type": "string", "setting": "in"}]`,
+		`[{"key": "name", "type": "string", "setting": "regex", "value": "(G"}]`,
+		`[{"key": "tags", "type": "array", "setting": "length", "value": "many"}]`,
+	}
+	for _, raw := range invalid {
+		_, err := parseRules(types.JSONText(raw))
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestRuleOperators(t *testing.T) {
+	event := setupTestNotifier(types.JSONText(`{"active": true, "name": "Gopher", "number": 12, "tags": ["new", 12]}`))
+
+	cases := []struct {
+		rule rule
+		met  bool
+	}{
+		{rule{Key: "active", Type: "boolean", Setting: "noteq", Value: "true"}, false},
+		{rule{Key: "active", Type: "boolean", Setting: "noteq", Value: "false"}, true},
+		{rule{Key: "number", Type: "number", Setting: "gte", Value: "12"}, true},
+		{rule{Key: "number", Type: "number", Setting: "gte", Value: "13"}, false},
+		{rule{Key: "number", Type: "number", Setting: "lte", Value: "12"}, true},
+		{rule{Key: "number", Type: "number", Setting: "lte", Value: "11"}, false},
+		{rule{Key: "number", Type: "number", Setting: "noteq", Value: "12"}, false},
+		{rule{Key: "number", Type: "number", Setting: "between", Values: []string{"10", "12"}}, true},
+		{rule{Key: "number", Type: "number", Setting: "between", Values: []string{"13", "20"}}, false},
+		{rule{Key: "name", Type: "string", Setting: "ieq", Value: "GOPHER"}, true},
+		{rule{Key: "name", Type: "string", Setting: "in", Values: []string{"Gopher", "Crab"}}, true},
+		{rule{Key: "name", Type: "string", Setting: "notin", Values: []string{"Gopher", "Crab"}}, false},
+		{rule{Key: "name", Type: "string", Setting: "contains", Value: "oph"}, true},
+		{rule{Key: "name", Type: "string", Setting: "starts_with", Value: "Go"}, true},
+		{rule{Key: "name", Type: "string", Setting: "ends_with", Value: "Go"}, false},
+		{rule{Key: "name", Type: "string", Setting: "regex", Value: "^Go.+r$"}, true},
+		{rule{Key: "name", Type: "string", Setting: "regex", Value: "^Rust"}, false},
+		{rule{Key: "tags", Type: "array", Setting: "contains", Value: "new"}, true},
+		{rule{Key: "tags", Type: "array", Setting: "contains", Value: "12"}, true},
+		{rule{Key: "tags", Type: "array", Setting: "contains", Value: "old"}, false},
+		{rule{Key: "tags", Type: "array", Setting: "length", Value: "2"}, true},
+		{rule{Key: "tags", Type: "array", Setting: "length_gt", Value: "2"}, false},
+		{rule{Key: "tags", Type: "array", Setting: "length_lt", Value: "3"}, true},
+	}
+	for _, c := range cases {
+		c.rule.compile()
+		assert.Equal(t, c.met, c.rule.Met(&event), c.rule.String())
+	}
+}
+
+func TestRuleCoercesNumericStrings(t *testing.T) {
+	event := setupTestNotifier(types.JSONText(`{"revenue": "120", "active": "true"}`))
+
+	r := rule{Key: "revenue", Type: "number", Setting: "gt", Value: "100"}
+	assert.Equal(t, true, r.Met(&event))
+
+	r = rule{Key: "active", Type: "boolean", Value: "true"}
+	assert.Equal(t, true, r.Met(&event))
+}
+
+func TestRuleTypeMismatchIsNotMet(t *testing.T) {
+	event := setupTestNotifier(types.JSONText(`{"revenue": "lots", "active": 1, "name": {"first": "Go"}, "tags": "new"}`))
+
+	rules := []rule{
+		{Key: "revenue", Type: "number", Setting: "gt", Value: "100"},
+		{Key: "active", Type: "boolean", Value: "true"},
+		{Key: "name", Type: "string", Value: "Go"},
+		{Key: "tags", Type: "array", Setting: "contains", Value: "new"},
+	}
+	for _, r := range rules {
+		met, reason, err := r.check(&event)
+		assert.Nil(t, err)
+		assert.False(t, met)
+		assert.Contains(t, reason, "expected")
+	}
+}
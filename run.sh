@@ -1 +1 @@
-go run notifilter.go endpoints.go rules.go notifier.go
+go run .
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// weekdays maps the day names used in schedules to time.Weekday
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleWindow is a period in which a notifier is active, like weekdays
+// from 09:00 to 18:00 in Europe/Amsterdam. A window that ends before it
+// starts runs past midnight.
+type scheduleWindow struct {
+	Days     []string `json:"days" yaml:"days"`
+	From     string   `json:"from" yaml:"from"`
+	To       string   `json:"to" yaml:"to"`
+	TimeZone string   `json:"time_zone" yaml:"time_zone"`
+
+	days     map[time.Weekday]bool
+	from, to int
+	location *time.Location
+}
+
+// parseSchedule strictly decodes and checks the windows of a schedule, an
+// empty schedule is always active
+func parseSchedule(raw types.JSONText) ([]*scheduleWindow, error) {
+	windows := []*scheduleWindow{}
+	trimmed := bytes.TrimSpace(raw)
+	// Empty JSONText is stored as {}
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) || bytes.Equal(trimmed, []byte("{}")) {
+		return windows, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&windows)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, w := range windows {
+		if w == nil {
+			return nil, fmt.Errorf("window %d is empty", i)
+		}
+		err := w.parse()
+		if err != nil {
+			return nil, fmt.Errorf("window %d: %s", i, err)
+		}
+	}
+	return windows, nil
+}
+
+func (w *scheduleWindow) parse() error {
+	var err error
+	w.from, err = parseTimeOfDay(w.From)
+	if err != nil {
+		return err
+	}
+	w.to, err = parseTimeOfDay(w.To)
+	if err != nil {
+		return err
+	}
+
+	w.location, err = time.LoadLocation(w.TimeZone)
+	if err != nil {
+		return fmt.Errorf("unknown time_zone %q", w.TimeZone)
+	}
+
+	w.days = map[time.Weekday]bool{}
+	for _, day := range w.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return fmt.Errorf("unknown day %q", day)
+		}
+		w.days[weekday] = true
+	}
+	return nil
+}
+
+// parseTimeOfDay returns the minutes since midnight of a "15:04" time
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q, expected HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// active returns whether t falls inside the window. Windows that run past
+// midnight belong to the day they start on.
+func (w *scheduleWindow) active(t time.Time) bool {
+	local := t.In(w.location)
+	minute := local.Hour()*60 + local.Minute()
+
+	day := local.Weekday()
+	switch {
+	case w.from == w.to:
+		// The whole day
+	case w.from < w.to:
+		if minute < w.from || minute >= w.to {
+			return false
+		}
+	case minute >= w.from:
+		// Before midnight of a window that runs past it
+	case minute < w.to:
+		// After midnight, the window started the day before
+		day = (day + 6) % 7
+	default:
+		return false
+	}
+
+	return len(w.days) == 0 || w.days[day]
+}
+
+// pausedReason returns why a notifier should not be checked at t, or an empty
+// string when it is active
+func (n *Notifier) pausedReason(t time.Time) string {
+	if !n.Enabled {
+		return "disabled"
+	}
+	if n.SnoozedUntil != nil && t.Before(*n.SnoozedUntil) {
+		return fmt.Sprintf("snoozed until %s", n.SnoozedUntil.Format(time.RFC3339))
+	}
+
+	windows, err := n.getSchedule()
+	if err != nil {
+		return fmt.Sprintf("invalid schedule: %s", err)
+	}
+	if len(windows) == 0 {
+		return ""
+	}
+	for _, w := range windows {
+		if w.active(t) {
+			return ""
+		}
+	}
+	return "outside of its schedule"
+}
+
+func (n *Notifier) getSchedule() ([]*scheduleWindow, error) {
+	if n.schedule != nil {
+		return n.schedule, nil
+	}
+	return parseSchedule(n.Schedule)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScheduleInvalid(t *testing.T) {
+	invalid := []string{
+		`{"from": "09:00"}`,
+		`[{"from": "9am", "to": "18:00"}]`,
+		`[{"from": "09:00", "to": "18:00", "time_zone": "Mars/Olympus"}]`,
+		`[{"from": "09:00", "to": "18:00", "days": ["someday"]}]`,
+		`[{"from": "09:00", "to": "18:00", "weekends": true}]`,
+	}
+	for _, raw := range invalid {
+		_, err := parseSchedule(types.JSONText(raw))
+		assert.NotNil(t, err, raw)
+	}
+
+	windows, err := parseSchedule(nil)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(windows))
+}
+
+func TestScheduleWindowActive(t *testing.T) {
+	windows, err := parseSchedule(types.JSONText(`[{"days": ["mon", "tue", "wed", "thu", "fri"], "from": "09:00", "to": "18:00", "time_zone": "Europe/Amsterdam"}]`))
+	assert.Nil(t, err)
+	w := windows[0]
+
+	amsterdam, _ := time.LoadLocation("Europe/Amsterdam")
+	// Monday 2024-01-08
+	assert.True(t, w.active(time.Date(2024, 1, 8, 9, 0, 0, 0, amsterdam)))
+	assert.True(t, w.active(time.Date(2024, 1, 8, 16, 59, 0, 0, time.UTC)))
+	assert.False(t, w.active(time.Date(2024, 1, 8, 17, 0, 0, 0, time.UTC)))
+	assert.False(t, w.active(time.Date(2024, 1, 8, 8, 59, 0, 0, amsterdam)))
+	// Saturday
+	assert.False(t, w.active(time.Date(2024, 1, 13, 12, 0, 0, 0, amsterdam)))
+}
+
+func TestScheduleWindowPastMidnight(t *testing.T) {
+	windows, err := parseSchedule(types.JSONText(`[{"days": ["fri"], "from": "22:00", "to": "06:00"}]`))
+	assert.Nil(t, err)
+	w := windows[0]
+
+	// Friday 2024-01-12 evening and the Saturday morning after
+	assert.True(t, w.active(time.Date(2024, 1, 12, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, w.active(time.Date(2024, 1, 13, 5, 59, 0, 0, time.UTC)))
+	assert.False(t, w.active(time.Date(2024, 1, 13, 6, 0, 0, 0, time.UTC)))
+	// Friday morning belongs to the window starting on Thursday
+	assert.False(t, w.active(time.Date(2024, 1, 12, 3, 0, 0, 0, time.UTC)))
+}
+
+func TestNotifierPausedReason(t *testing.T) {
+	now := time.Date(2024, 1, 8, 12, 0, 0, 0, time.UTC)
+
+	n := Notifier{Enabled: false}
+	assert.Equal(t, "disabled", n.pausedReason(now))
+
+	until := now.Add(time.Hour)
+	n = Notifier{Enabled: true, SnoozedUntil: &until}
+	assert.Contains(t, n.pausedReason(now), "snoozed until")
+	assert.Equal(t, "", n.pausedReason(until))
+
+	n = Notifier{Enabled: true, Schedule: types.JSONText(`[{"from": "13:00", "to": "14:00"}]`)}
+	assert.Equal(t, "outside of its schedule", n.pausedReason(now))
+	assert.Equal(t, "", n.pausedReason(now.Add(time.Hour)))
+}
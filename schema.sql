@@ -15,3 +15,95 @@ CREATE INDEX index_application_event_name ON notifiers (application, event_name)
 
 ALTER TABLE ONLY notifiers
   ALTER rules SET DEFAULT '[]'::json;
+
+ALTER TABLE notifiers
+  ADD COLUMN max_retries integer NOT NULL DEFAULT 3;
+
+CREATE table dead_letters(
+  id serial primary key,
+  notifier_id integer REFERENCES notifiers (id) ON DELETE CASCADE,
+  request_id character varying(40),
+  notification_type character varying(20),
+  target character varying(256),
+  event_name character varying(256),
+  message text,
+  error text,
+  response text,
+  attempts integer,
+  created_at timestamp NOT NULL DEFAULT now(),
+  redriven_at timestamp
+);
+
+CREATE INDEX index_dead_letters_notifier_id ON dead_letters (notifier_id);
+
+CREATE table deliveries(
+  id serial primary key,
+  request_id character varying(40),
+  notifier_id integer REFERENCES notifiers (id) ON DELETE CASCADE,
+  matched boolean NOT NULL DEFAULT false,
+  failed_rule text NOT NULL DEFAULT '',
+  message text NOT NULL DEFAULT '',
+  channel character varying(20),
+  target character varying(256),
+  status character varying(20),
+  error text NOT NULL DEFAULT '',
+  response text NOT NULL DEFAULT '',
+  attempts integer NOT NULL DEFAULT 0,
+  created_at timestamp NOT NULL,
+  finished_at timestamp NOT NULL
+);
+
+CREATE INDEX index_deliveries_notifier_id ON deliveries (notifier_id);
+CREATE INDEX index_deliveries_request_id ON deliveries (request_id);
+
+-- Let running instances know they need to reload their notifiers
+CREATE OR REPLACE FUNCTION notify_notifiers_changed() RETURNS trigger AS $$
+BEGIN
+  PERFORM pg_notify('notifiers_changed', TG_OP);
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER notifiers_changed
+  AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON notifiers
+  FOR EACH STATEMENT EXECUTE PROCEDURE notify_notifiers_changed();
+
+-- Notifiers synced from files have their source set to 'file'
+ALTER TABLE notifiers
+  ADD COLUMN source character varying(20) NOT NULL DEFAULT '';
+
+-- Notifiers can be paused, snoozed or limited to a schedule
+ALTER TABLE notifiers
+  ADD COLUMN enabled boolean NOT NULL DEFAULT true,
+  ADD COLUMN snoozed_until timestamp with time zone,
+  ADD COLUMN schedule json NOT NULL DEFAULT '[]'::json;
+
+-- Rate limits and deduplication of notifications
+ALTER TABLE notifiers
+  ADD COLUMN throttle json NOT NULL DEFAULT '{}'::json;
+
+-- Notifiers that only exist in files have negative IDs without a row, so
+-- deliveries and dead letters no longer refer to the notifiers table. They are
+-- removed together with the notifier by a trigger instead.
+ALTER TABLE dead_letters DROP CONSTRAINT dead_letters_notifier_id_fkey;
+ALTER TABLE deliveries DROP CONSTRAINT deliveries_notifier_id_fkey;
+
+CREATE OR REPLACE FUNCTION delete_notifier_history() RETURNS trigger AS $$
+BEGIN
+  DELETE FROM deliveries WHERE notifier_id = OLD.id;
+  DELETE FROM dead_letters WHERE notifier_id = OLD.id;
+  RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER notifiers_deleted
+  AFTER DELETE ON notifiers
+  FOR EACH ROW EXECUTE PROCEDURE delete_notifier_history();
+
+-- Notifiers synced from files are matched on the key they have there. Every
+-- key is only stored once, so instances syncing at the same time can not
+-- create duplicates. Rows synced before keys existed keep an empty key and
+-- are removed by the next sync.
+ALTER TABLE notifiers
+  ADD COLUMN file_key text NOT NULL DEFAULT '';
+CREATE UNIQUE INDEX index_notifiers_file_key ON notifiers (file_key) WHERE source = 'file' AND file_key <> '';
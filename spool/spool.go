@@ -0,0 +1,379 @@
+// Package spool provides a segmented write-ahead log that keeps events on disk
+// until they have been fully processed, so they survive restarts and crashes
+package spool
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	segmentExt = ".seg"
+	ackExt     = ".ack"
+)
+
+// MaxRecordSize is the largest ID or data a record can have, a larger length
+// read from a segment means it is corrupt
+const MaxRecordSize = 16 * 1024 * 1024
+
+// errCorrupt is returned when a record in a segment has an impossible length
+var errCorrupt = errors.New("corrupt record")
+
+// Record is a single spooled entry, Done lists the stages that were marked as
+// done before it was replayed
+type Record struct {
+	ID   string
+	Data []byte
+	Done []string
+}
+
+// segment is a pair of files, one with the appended records and one with the
+// IDs of the records that have been acknowledged since. A line in the second
+// file with an ID followed by a stage marks that stage as done.
+type segment struct {
+	seq     uint64
+	size    int64
+	pending map[string]bool
+	acks    *os.File
+}
+
+// Spool appends records to the active segment and removes segments once all
+// of their records have been acknowledged
+type Spool struct {
+	mu             sync.Mutex
+	dir            string
+	maxSegmentSize int64
+	segments       map[uint64]*segment
+	index          map[string]uint64
+	active         *segment
+	data           *os.File
+	replay         []Record
+}
+
+// Open loads the existing segments in dir, remembering the records that were
+// never acknowledged so they can be replayed, and starts a new active segment
+func Open(dir string, maxSegmentSize int64) (*Spool, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		dir:            dir,
+		maxSegmentSize: maxSegmentSize,
+		segments:       map[uint64]*segment{},
+		index:          map[string]uint64{},
+		replay:         []Record{},
+	}
+
+	seqs, err := s.segmentSeqs()
+	if err != nil {
+		return nil, err
+	}
+
+	var last uint64
+	for _, seq := range seqs {
+		last = seq
+		err := s.load(seq)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.rotate(last + 1)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// segmentSeqs returns the sequence numbers of the segments on disk, oldest first
+func (s *Spool) segmentSeqs() ([]uint64, error) {
+	matches, err := filepath.Glob(filepath.Join(s.dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+
+	seqs := []uint64{}
+	for _, match := range matches {
+		name := strings.TrimSuffix(filepath.Base(match), segmentExt)
+		seq, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+func (s *Spool) path(seq uint64, ext string) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%020d%s", seq, ext))
+}
+
+// load reads a segment left behind by a previous run
+func (s *Spool) load(seq uint64) error {
+	acked := map[string]bool{}
+	done := map[string][]string{}
+	ackFile, err := os.Open(s.path(seq, ackExt))
+	if err == nil {
+		scanner := bufio.NewScanner(ackFile)
+		for scanner.Scan() {
+			id, stage, marked := strings.Cut(scanner.Text(), " ")
+			if marked {
+				done[id] = append(done[id], stage)
+				continue
+			}
+			acked[id] = true
+		}
+		ackFile.Close()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	f, err := os.Open(s.path(seq, segmentExt))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	seg := &segment{seq: seq, pending: map[string]bool{}}
+	r := bufio.NewReader(f)
+	for {
+		rec, err := readRecord(r)
+		if err == io.EOF || err == io.ErrUnexpectedEOF || err == errCorrupt {
+			// A partially written record at the end means we crashed while
+			// appending it, it was never acknowledged to the sender. After a
+			// corrupt one we can not tell where the next record starts.
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if acked[rec.ID] {
+			continue
+		}
+		rec.Done = done[rec.ID]
+		seg.pending[rec.ID] = true
+		s.index[rec.ID] = seq
+		s.replay = append(s.replay, rec)
+	}
+
+	if len(seg.pending) == 0 {
+		return s.remove(seg)
+	}
+	s.segments[seq] = seg
+	return nil
+}
+
+// rotate closes the active segment and starts a new one
+func (s *Spool) rotate(seq uint64) error {
+	if s.data != nil {
+		err := s.data.Sync()
+		if err != nil {
+			return err
+		}
+		s.data.Close()
+	}
+	if s.active != nil && len(s.active.pending) == 0 {
+		err := s.remove(s.active)
+		if err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(s.path(seq, segmentExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	s.data = f
+	s.active = &segment{seq: seq, pending: map[string]bool{}}
+	s.segments[seq] = s.active
+	return nil
+}
+
+// remove deletes a fully acknowledged segment from disk
+func (s *Spool) remove(seg *segment) error {
+	if seg.acks != nil {
+		seg.acks.Close()
+	}
+	delete(s.segments, seg.seq)
+
+	for _, ext := range []string{segmentExt, ackExt} {
+		err := os.Remove(s.path(seg.seq, ext))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Append writes a record to the active segment, it is only guaranteed to be
+// on disk after Sync
+func (s *Spool) Append(id string, data []byte) error {
+	if len(id) > MaxRecordSize || len(data) > MaxRecordSize {
+		return fmt.Errorf("record %s is larger than %d bytes", id, MaxRecordSize)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.active.size >= s.maxSegmentSize {
+		err := s.rotate(s.active.seq + 1)
+		if err != nil {
+			return err
+		}
+	}
+
+	buf := encodeRecord(Record{ID: id, Data: data})
+	_, err := s.data.Write(buf)
+	if err != nil {
+		return err
+	}
+
+	s.active.size += int64(len(buf))
+	s.active.pending[id] = true
+	s.index[id] = s.active.seq
+	return nil
+}
+
+// Sync flushes the records appended to the active segment to disk, so a batch
+// of records only costs a single fsync
+func (s *Spool) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.data.Sync()
+}
+
+// Ack marks a record as processed. Once every record in a segment has been
+// acknowledged, and it is no longer the active segment, it is removed.
+func (s *Spool) Ack(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, ok := s.index[id]
+	if !ok {
+		return nil
+	}
+	seg := s.segments[seq]
+	delete(s.index, id)
+	delete(seg.pending, id)
+
+	if seg != s.active && len(seg.pending) == 0 {
+		return s.remove(seg)
+	}
+	return s.writeAck(seg, id)
+}
+
+// MarkDone records that a stage of a record is done, so it is not repeated
+// when the record is replayed
+func (s *Spool) MarkDone(id string, stage string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	seq, ok := s.index[id]
+	if !ok {
+		return nil
+	}
+	return s.writeAck(s.segments[seq], id+" "+stage)
+}
+
+// writeAck adds a line to the ack file of a segment. Losing one only means a
+// record or stage is replayed once more, so there is no need to sync these.
+func (s *Spool) writeAck(seg *segment, line string) error {
+	if seg.acks == nil {
+		f, err := os.OpenFile(s.path(seg.seq, ackExt), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		seg.acks = f
+	}
+	_, err := seg.acks.Write([]byte(line + "\n"))
+	return err
+}
+
+// Replay returns the records that were not acknowledged before the spool was
+// last closed, in the order they were appended. It only returns them once.
+func (s *Spool) Replay() []Record {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	replay := s.replay
+	s.replay = []Record{}
+	return replay
+}
+
+// Pending returns the amount of records that have not been acknowledged yet
+func (s *Spool) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.index)
+}
+
+// Close closes all open segment files
+func (s *Spool) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, seg := range s.segments {
+		if seg.acks != nil {
+			seg.acks.Close()
+		}
+	}
+	s.data.Sync()
+	return s.data.Close()
+}
+
+// encodeRecord frames a record as the length of the ID, the ID, the length of
+// the data and the data itself
+func encodeRecord(rec Record) []byte {
+	buf := make([]byte, 8+len(rec.ID)+len(rec.Data))
+	binary.BigEndian.PutUint32(buf, uint32(len(rec.ID)))
+	copy(buf[4:], rec.ID)
+	binary.BigEndian.PutUint32(buf[4+len(rec.ID):], uint32(len(rec.Data)))
+	copy(buf[8+len(rec.ID):], rec.Data)
+	return buf
+}
+
+func readRecord(r io.Reader) (Record, error) {
+	id, err := readField(r)
+	if err != nil {
+		return Record{}, err
+	}
+	data, err := readField(r)
+	if err == io.EOF {
+		return Record{}, io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{ID: string(id), Data: data}, nil
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var size uint32
+	err := binary.Read(r, binary.BigEndian, &size)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxRecordSize {
+		return nil, errCorrupt
+	}
+	field := make([]byte, size)
+	_, err = io.ReadFull(r, field)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return field, err
+}
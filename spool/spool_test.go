@@ -0,0 +1,107 @@
+package spool
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tempSpool(t *testing.T, maxSegmentSize int64) (*Spool, string) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir, maxSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, dir
+}
+
+func segmentFiles(dir string) []string {
+	matches, _ := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	return matches
+}
+
+func TestReplayUnacknowledged(t *testing.T) {
+	s, dir := tempSpool(t, 1024)
+	defer os.RemoveAll(dir)
+
+	s.Append("a", []byte("first"))
+	s.Append("b", []byte("second"))
+	s.Append("c", []byte("third"))
+	s.Ack("b")
+	s.Close()
+
+	s, err := Open(dir, 1024)
+	assert.Nil(t, err)
+	replay := s.Replay()
+	assert.Equal(t, []Record{{ID: "a", Data: []byte("first")}, {ID: "c", Data: []byte("third")}}, replay)
+	assert.Equal(t, 2, s.Pending())
+	assert.Equal(t, 0, len(s.Replay()))
+	s.Close()
+}
+
+func TestCompactsAcknowledgedSegments(t *testing.T) {
+	s, dir := tempSpool(t, 1)
+	defer os.RemoveAll(dir)
+
+	s.Append("a", []byte("first"))
+	s.Append("b", []byte("second"))
+	assert.Equal(t, 2, len(segmentFiles(dir)))
+
+	s.Ack("a")
+	assert.Equal(t, 1, len(segmentFiles(dir)))
+	assert.Equal(t, 1, s.Pending())
+	s.Close()
+}
+
+func TestIgnoresPartialRecord(t *testing.T) {
+	s, dir := tempSpool(t, 1024)
+	defer os.RemoveAll(dir)
+
+	s.Append("a", []byte("first"))
+	s.data.Write(encodeRecord(Record{ID: "b", Data: []byte("second")})[:6])
+	s.Close()
+
+	s, err := Open(dir, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{{ID: "a", Data: []byte("first")}}, s.Replay())
+	s.Close()
+}
+
+func TestIgnoresCorruptRecord(t *testing.T) {
+	s, dir := tempSpool(t, 1024)
+	defer os.RemoveAll(dir)
+
+	s.Append("a", []byte("first"))
+	s.data.Write([]byte{0xff, 0xff, 0xff, 0xff, 'b'})
+	s.Close()
+
+	s, err := Open(dir, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{{ID: "a", Data: []byte("first")}}, s.Replay())
+	assert.NotNil(t, s.Append("c", make([]byte, MaxRecordSize+1)))
+	s.Close()
+}
+
+func TestReplayKeepsDoneStages(t *testing.T) {
+	s, dir := tempSpool(t, 1024)
+	defer os.RemoveAll(dir)
+
+	s.Append("a", []byte("first"))
+	s.Append("b", []byte("second"))
+	assert.Nil(t, s.Sync())
+	s.MarkDone("a", "notify")
+	s.MarkDone("b", "notify")
+	s.Ack("b")
+	s.Close()
+
+	s, err := Open(dir, 1024)
+	assert.Nil(t, err)
+	assert.Equal(t, []Record{{ID: "a", Data: []byte("first"), Done: []string{"notify"}}}, s.Replay())
+	s.Close()
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxSampleSize is how much of a rejected payload we keep around
+const maxSampleSize = 1024
+
+// Reasons we keep track of when we can not accept or process an event
+const (
+	rejectMalformed     = "malformed"
+	rejectOversized     = "oversized"
+	rejectMissingFields = "missing_fields"
+	rejectQueueFull     = "queue_full"
+	rejectPersistFailed = "persist_failed"
+	rejectNotifyFailed  = "notify_failed"
+	rejectReadError     = "read_error"
+)
+
+// rejectedPayload is a sample of an event we rejected, kept for debugging
+type rejectedPayload struct {
+	Reason     string    `json:"reason"`
+	Error      string    `json:"error"`
+	Payload    string    `json:"payload"`
+	RejectedAt time.Time `json:"rejected_at"`
+}
+
+// rejectionStats counts the events we dropped, rejected or failed to process
+// and keeps a ring buffer with a sample of the rejected payloads
+type rejectionStats struct {
+	counts map[string]*int64
+
+	mu         sync.Mutex
+	samples    []rejectedPayload
+	next       int
+	seen       int64
+	sampleRate int64
+}
+
+// rejectionCounts describes our rejection counters for /v1/statistics
+type rejectionCounts struct {
+	Malformed     int64
+	Oversized     int64
+	MissingFields int64
+	QueueFull     int64
+	PersistFailed int64
+	NotifyFailed  int64
+	ReadErrors    int64
+}
+
+// rejections is shared by our listeners and workers
+var rejections = newRejectionStats(50, 1)
+
+// newRejectionStats keeps up to size samples, of every sampleRate'th rejection
+func newRejectionStats(size int, sampleRate int) *rejectionStats {
+	if sampleRate < 1 {
+		sampleRate = 1
+	}
+
+	counts := map[string]*int64{}
+	for _, reason := range []string{rejectMalformed, rejectOversized, rejectMissingFields, rejectQueueFull, rejectPersistFailed, rejectNotifyFailed, rejectReadError} {
+		counts[reason] = new(int64)
+	}
+
+	return &rejectionStats{
+		counts:     counts,
+		samples:    make([]rejectedPayload, 0, size),
+		sampleRate: int64(sampleRate),
+	}
+}
+
+// reject counts a rejection and samples its payload, payload can be nil when
+// we never got to read it
+func (rs *rejectionStats) reject(reason string, err error, payload []byte) {
+	atomic.AddInt64(rs.counts[reason], 1)
+	eventsRejected.WithLabelValues(reason).Inc()
+	if cap(rs.samples) == 0 || payload == nil {
+		return
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.seen++
+	if rs.seen%rs.sampleRate != 0 {
+		return
+	}
+
+	if len(payload) > maxSampleSize {
+		payload = payload[:maxSampleSize]
+	}
+	sample := rejectedPayload{
+		Reason:     reason,
+		Payload:    string(payload),
+		RejectedAt: time.Now(),
+	}
+	if err != nil {
+		sample.Error = err.Error()
+	}
+
+	if len(rs.samples) < cap(rs.samples) {
+		rs.samples = append(rs.samples, sample)
+	} else {
+		rs.samples[rs.next] = sample
+	}
+	rs.next = (rs.next + 1) % cap(rs.samples)
+}
+
+func (rs *rejectionStats) counters() rejectionCounts {
+	return rejectionCounts{
+		Malformed:     atomic.LoadInt64(rs.counts[rejectMalformed]),
+		Oversized:     atomic.LoadInt64(rs.counts[rejectOversized]),
+		MissingFields: atomic.LoadInt64(rs.counts[rejectMissingFields]),
+		QueueFull:     atomic.LoadInt64(rs.counts[rejectQueueFull]),
+		PersistFailed: atomic.LoadInt64(rs.counts[rejectPersistFailed]),
+		NotifyFailed:  atomic.LoadInt64(rs.counts[rejectNotifyFailed]),
+		ReadErrors:    atomic.LoadInt64(rs.counts[rejectReadError]),
+	}
+}
+
+// recent returns the sampled payloads, newest first
+func (rs *rejectionStats) recent() []rejectedPayload {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	recent := make([]rejectedPayload, 0, len(rs.samples))
+	for i := 1; i <= len(rs.samples); i++ {
+		idx := (rs.next - i + len(rs.samples)) % len(rs.samples)
+		recent = append(recent, rs.samples[idx])
+	}
+	return recent
+}
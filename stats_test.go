@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRejectionCounters(t *testing.T) {
+	rs := newRejectionStats(5, 1)
+	rs.reject(rejectMalformed, errors.New("bad json"), []byte("{"))
+	rs.reject(rejectMalformed, nil, []byte("}"))
+	rs.reject(rejectQueueFull, nil, nil)
+
+	counts := rs.counters()
+	assert.Equal(t, int64(2), counts.Malformed)
+	assert.Equal(t, int64(1), counts.QueueFull)
+	assert.Equal(t, int64(0), counts.PersistFailed)
+}
+
+func TestRejectionSamplesRing(t *testing.T) {
+	rs := newRejectionStats(2, 1)
+	rs.reject(rejectMalformed, errors.New("bad json"), []byte("a"))
+	rs.reject(rejectMalformed, nil, []byte("b"))
+	rs.reject(rejectMalformed, nil, []byte("c"))
+
+	recent := rs.recent()
+	assert.Equal(t, 2, len(recent))
+	assert.Equal(t, "c", recent[0].Payload)
+	assert.Equal(t, "b", recent[1].Payload)
+}
+
+func TestRejectionSampleRate(t *testing.T) {
+	rs := newRejectionStats(10, 2)
+	for _, payload := range []string{"a", "b", "c", "d"} {
+		rs.reject(rejectMissingFields, nil, []byte(payload))
+	}
+
+	recent := rs.recent()
+	assert.Equal(t, 2, len(recent))
+	assert.Equal(t, "d", recent[0].Payload)
+	assert.Equal(t, int64(4), rs.counters().MissingFields)
+}
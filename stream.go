@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Framings supported by the TCP and Unix socket listeners. With newline
+// framing every line is an event, with length framing every event is preceded
+// by its size as a 4 byte big-endian unsigned integer.
+const (
+	framingNewline = "newline"
+	framingLength  = "length"
+)
+
+// errFrameTooLarge is returned when a frame exceeds maxPacketSize
+var errFrameTooLarge = errors.New("frame exceeds maximum size")
+
+// streamListener accepts connections on a TCP or Unix socket and feeds the
+// frames read from them into the same pipeline as our UDP listener
+type streamListener struct {
+	listener    net.Listener
+	framing     string
+	readTimeout time.Duration
+	// slots limits the amount of connections we handle at the same time
+	slots chan struct{}
+
+	// conns are the open connections, they are closed together with the
+	// listener when shutting down
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func newStreamListener(network string, address string, framing string, readTimeout time.Duration, maxConnections int) (*streamListener, error) {
+	if framing != framingNewline && framing != framingLength {
+		return nil, fmt.Errorf("unknown framing %q, use %q or %q", framing, framingNewline, framingLength)
+	}
+	if maxConnections < 1 {
+		return nil, fmt.Errorf("maximum connections should be at least 1, got %d", maxConnections)
+	}
+
+	if network == "unix" {
+		// A socket file left behind by a previous run would make Listen fail
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &streamListener{
+		listener:    l,
+		framing:     framing,
+		readTimeout: readTimeout,
+		slots:       make(chan struct{}, maxConnections),
+		conns:       map[net.Conn]bool{},
+	}, nil
+}
+
+// acceptRetryDelay is how long we wait after a failed Accept before trying
+// again, so errors like running out of file descriptors do not spin
+const acceptRetryDelay = 100 * time.Millisecond
+
+// listen accepts connections until the listener is closed. Frames are handed
+// to incomingChan until quit is closed.
+func (s *streamListener) listen(incomingChan chan<- incomingItem, quit <-chan struct{}) {
+	addr := s.listener.Addr()
+	for {
+		conn, err := s.listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			log.Printf("%s listener on %s stopped\n", addr.Network(), addr)
+			return
+		}
+		if err != nil {
+			log.Printf("%s accept error: %s\n", addr.Network(), err)
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+
+		select {
+		case s.slots <- struct{}{}:
+		default:
+			log.Printf("%s connection limit of %d reached, closing connection from %s\n", addr.Network(), cap(s.slots), conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
+		if !s.track(conn) {
+			<-s.slots
+			conn.Close()
+			return
+		}
+
+		go func() {
+			defer func() { <-s.slots }()
+			defer s.untrack(conn)
+
+			err := readFrames(conn, s.framing, s.readTimeout, func(frame []byte) error {
+				select {
+				case incomingChan <- incomingItem{payload: frame}:
+					return nil
+				case <-quit:
+					return errShuttingDown
+				}
+			})
+			if err == nil || errors.Is(err, errShuttingDown) || errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("%s read error: %s\n", addr.Network(), err)
+			if errors.Is(err, errFrameTooLarge) {
+				rejections.reject(rejectOversized, err, nil)
+			} else {
+				rejections.reject(rejectReadError, err, nil)
+			}
+		}()
+	}
+}
+
+// track adds an accepted connection, it returns false once the listener has
+// been closed
+func (s *streamListener) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = true
+	return true
+}
+
+func (s *streamListener) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	conn.Close()
+}
+
+// Close stops accepting connections and closes the open ones, frames that
+// were not read completely are lost
+func (s *streamListener) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	return s.listener.Close()
+}
+
+// readFrames reads frames from conn until it is closed by the other side and
+// hands every frame to fn, it stops at the first error fn returns. The read
+// deadline is reset before every frame, so an idle connection is closed after
+// readTimeout, like a normal close that is not an error. Reaching the deadline
+// in the middle of a frame is an error, the frame is truncated.
+func readFrames(conn net.Conn, framing string, readTimeout time.Duration, fn func([]byte) error) error {
+	setDeadline := func() {
+		if readTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(readTimeout))
+		}
+	}
+
+	r := bufio.NewReaderSize(conn, 64*1024)
+	if framing == framingLength {
+		var header [4]byte
+		for {
+			setDeadline()
+			n, err := io.ReadFull(r, header[:])
+			if n == 0 && (err == io.EOF || errors.Is(err, os.ErrDeadlineExceeded)) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			size := binary.BigEndian.Uint32(header[:])
+			if size > maxPacketSize {
+				return fmt.Errorf("%w: %d bytes, maximum is %d", errFrameTooLarge, size, maxPacketSize)
+			}
+
+			frame := make([]byte, size)
+			_, err = io.ReadFull(r, frame)
+			if err != nil {
+				return err
+			}
+			err = fn(frame)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for {
+		setDeadline()
+		line, err := readLine(r)
+		if err != nil && err != io.EOF {
+			if len(line) == 0 && errors.Is(err, os.ErrDeadlineExceeded) {
+				return nil
+			}
+			return err
+		}
+
+		frame := bytes.TrimRight(line, "\r\n")
+		if len(frame) > 0 {
+			ferr := fn(frame)
+			if ferr != nil {
+				return ferr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// readLine reads up to and including the next newline, a line without one is
+// returned with the error that ended it
+func readLine(r *bufio.Reader) ([]byte, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(bytes.TrimRight(line, "\r\n")) > maxPacketSize {
+			return line, fmt.Errorf("%w: line is longer than %d bytes", errFrameTooLarge, maxPacketSize)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		return line, err
+	}
+}
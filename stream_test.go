@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func collectFrames(t *testing.T, framing string, write func(net.Conn)) [][]byte {
+	server, client := net.Pipe()
+	go func() {
+		write(client)
+		client.Close()
+	}()
+
+	frames := [][]byte{}
+	err := readFrames(server, framing, time.Second, func(frame []byte) error {
+		frames = append(frames, frame)
+		return nil
+	})
+	assert.Nil(t, err)
+	return frames
+}
+
+func TestReadFramesNewline(t *testing.T) {
+	frames := collectFrames(t, framingNewline, func(c net.Conn) {
+		c.Write([]byte("{\"identifier\": \"a\"}\n\n{\"identifier\": \"b\"}\n"))
+	})
+
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, `{"identifier": "b"}`, string(frames[1]))
+}
+
+func TestReadFramesLength(t *testing.T) {
+	frames := collectFrames(t, framingLength, func(c net.Conn) {
+		for _, event := range []string{`{"identifier": "a"}`, "{\n\"identifier\": \"b\"\n}"} {
+			binary.Write(c, binary.BigEndian, uint32(len(event)))
+			c.Write([]byte(event))
+		}
+	})
+
+	assert.Equal(t, 2, len(frames))
+	assert.Equal(t, "{\n\"identifier\": \"b\"\n}", string(frames[1]))
+}
+
+func TestReadFramesLengthTooLarge(t *testing.T) {
+	server, client := net.Pipe()
+	go func() {
+		binary.Write(client, binary.BigEndian, uint32(maxPacketSize+1))
+		client.Close()
+	}()
+
+	err := readFrames(server, framingLength, time.Second, func(frame []byte) error { return nil })
+	assert.True(t, errors.Is(err, errFrameTooLarge))
+}
+
+func TestReadFramesIdleTimeout(t *testing.T) {
+	for _, framing := range []string{framingNewline, framingLength} {
+		server, client := net.Pipe()
+		defer client.Close()
+
+		err := readFrames(server, framing, 10*time.Millisecond, func(frame []byte) error { return nil })
+		assert.Nil(t, err, framing)
+	}
+}
+
+func TestReadFramesTruncatedFrame(t *testing.T) {
+	writes := map[string]func(net.Conn){
+		"length header": func(c net.Conn) { c.Write([]byte{0, 0}) },
+		"length frame": func(c net.Conn) {
+			binary.Write(c, binary.BigEndian, uint32(10))
+			c.Write([]byte("{}"))
+		},
+		"newline": func(c net.Conn) { c.Write([]byte(`{"identifier": "a"}` + "\n" + `{"identi`)) },
+	}
+	for name, write := range writes {
+		framing := framingLength
+		if name == framingNewline {
+			framing = framingNewline
+		}
+		server, client := net.Pipe()
+		go write(client)
+
+		frames := 0
+		err := readFrames(server, framing, 50*time.Millisecond, func(frame []byte) error {
+			frames++
+			return nil
+		})
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded), name)
+		client.Close()
+		if framing == framingNewline {
+			assert.Equal(t, 1, frames)
+		}
+	}
+}
+
+func TestReadFramesStopsOnError(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("a\nb\n"))
+
+	frames := 0
+	err := readFrames(server, framingNewline, time.Second, func(frame []byte) error {
+		frames++
+		return errShuttingDown
+	})
+	assert.Equal(t, errShuttingDown, err)
+	assert.Equal(t, 1, frames)
+}
+
+func TestStreamListenerClose(t *testing.T) {
+	s, err := newStreamListener("tcp", "127.0.0.1:0", framingNewline, time.Minute, 2)
+	assert.Nil(t, err)
+	incoming := make(chan incomingItem)
+	quit := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		s.listen(incoming, quit)
+		close(stopped)
+	}()
+
+	conn, err := net.Dial("tcp", s.listener.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+	conn.Write([]byte("{}\n{}\n"))
+	item := <-incoming
+	assert.Equal(t, "{}", string(item.payload))
+
+	// Nobody takes the second frame, quit releases the connection
+	close(quit)
+	s.Close()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("listener did not stop")
+	}
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.NotNil(t, err)
+	assert.False(t, errors.Is(err, os.ErrDeadlineExceeded))
+	assert.Eventually(t, func() bool { return len(s.slots) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestNewStreamListenerUnknownFraming(t *testing.T) {
+	_, err := newStreamListener("tcp", "127.0.0.1:0", "xml", time.Second, 1)
+	assert.NotNil(t, err)
+}
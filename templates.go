@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"sync"
+	"text/template"
+)
+
+// compiledTemplate is a parsed notifier template together with the source it
+// was parsed from, so we know when it has to be parsed again
+type compiledTemplate struct {
+	source   string
+	template *template.Template
+	err      error
+}
+
+// templateCache keeps the parsed template of every notifier between reloads,
+// templates are only parsed again when their source changes
+type templateCache struct {
+	mu        sync.Mutex
+	templates map[int]compiledTemplate
+}
+
+// templates is shared by all notifier cache reloads
+var templates = newTemplateCache()
+
+func newTemplateCache() *templateCache {
+	return &templateCache{templates: map[int]compiledTemplate{}}
+}
+
+// get returns the parsed template of a notifier. fresh is true when the source
+// was parsed by this call, so callers can report a bad template only once.
+func (tc *templateCache) get(id int, source string) (ct compiledTemplate, fresh bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	ct, ok := tc.templates[id]
+	if ok && ct.source == source {
+		return ct, false
+	}
+
+	t, err := parseTemplate(source)
+	ct = compiledTemplate{source: source, template: t, err: err}
+	tc.templates[id] = ct
+	return ct, true
+}
+
+// retain drops the templates of notifiers that no longer exist
+func (tc *templateCache) retain(ids map[int]bool) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+
+	for id := range tc.templates {
+		if !ids[id] {
+			delete(tc.templates, id)
+		}
+	}
+}
+
+func parseTemplate(source string) (*template.Template, error) {
+	return template.New("notificationTemplate").Funcs(funcMap).Parse(source)
+}
+
+func executeTemplate(t *template.Template, e *Event) ([]byte, error) {
+	var doc bytes.Buffer
+
+	err := t.Execute(&doc, e.dataToMap())
+	if err != nil {
+		return []byte(""), err
+	}
+
+	return doc.Bytes(), nil
+}
+
+// renderTemplate parses and renders a template that is not cached, like the
+// ones sent to /v1/preview
+func renderTemplate(source string, e *Event) ([]byte, error) {
+	t, err := parseTemplate(source)
+	if err != nil {
+		return []byte(""), err
+	}
+
+	return executeTemplate(t, e)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTemplateCacheParsesOnlyOnChange(t *testing.T) {
+	tc := newTemplateCache()
+
+	ct, fresh := tc.get(1, "{{ .name }}")
+	assert.True(t, fresh)
+	assert.Nil(t, ct.err)
+
+	cached, fresh := tc.get(1, "{{ .name }}")
+	assert.False(t, fresh)
+	assert.True(t, ct.template == cached.template)
+
+	changed, fresh := tc.get(1, "{{ .number }}")
+	assert.True(t, fresh)
+	assert.False(t, ct.template == changed.template)
+}
+
+func TestTemplateCacheKeepsParseError(t *testing.T) {
+	tc := newTemplateCache()
+
+	ct, fresh := tc.get(1, "{{ .name ")
+	assert.True(t, fresh)
+	assert.NotNil(t, ct.err)
+
+	ct, fresh = tc.get(1, "{{ .name ")
+	assert.False(t, fresh)
+	assert.NotNil(t, ct.err)
+}
+
+func TestTemplateCacheRetain(t *testing.T) {
+	tc := newTemplateCache()
+	tc.get(1, "one")
+	tc.get(2, "two")
+
+	tc.retain(map[int]bool{2: true})
+	_, fresh := tc.get(1, "one")
+	assert.True(t, fresh)
+	_, fresh = tc.get(2, "two")
+	assert.False(t, fresh)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+)
+
+// throttleSettings limits how often a notifier sends messages. At most Max
+// messages are sent per Window, and a message is only sent once per
+// DedupWindow for every value of DedupKey, a template rendered with the event
+// data like "{{ .user_id }}".
+type throttleSettings struct {
+	Max         int    `json:"max,omitempty" yaml:"max"`
+	Window      string `json:"window,omitempty" yaml:"window"`
+	DedupKey    string `json:"dedup_key,omitempty" yaml:"dedup_key"`
+	DedupWindow string `json:"dedup_window,omitempty" yaml:"dedup_window"`
+
+	window      time.Duration
+	dedupWindow time.Duration
+	dedup       *template.Template
+}
+
+// parseThrottle strictly decodes and checks throttle settings, it returns nil
+// when the notifier is not throttled
+func parseThrottle(raw types.JSONText) (*throttleSettings, error) {
+	trimmed := bytes.TrimSpace(raw)
+	if len(trimmed) == 0 || bytes.Equal(trimmed, []byte("null")) {
+		return nil, nil
+	}
+
+	var ts throttleSettings
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.DisallowUnknownFields()
+	err := decoder.Decode(&ts)
+	if err != nil {
+		return nil, err
+	}
+	err = ts.parse()
+	if err != nil {
+		return nil, err
+	}
+	if ts.Max == 0 && ts.dedup == nil {
+		return nil, nil
+	}
+	return &ts, nil
+}
+
+func (ts *throttleSettings) parse() error {
+	var err error
+	if ts.Max < 0 {
+		return fmt.Errorf("max can not be negative")
+	}
+	if ts.Max > 0 {
+		ts.window, err = time.ParseDuration(ts.Window)
+		if err != nil || ts.window <= 0 {
+			return fmt.Errorf("invalid window %q", ts.Window)
+		}
+	}
+
+	if ts.DedupKey != "" {
+		ts.dedupWindow, err = time.ParseDuration(ts.DedupWindow)
+		if err != nil || ts.dedupWindow <= 0 {
+			return fmt.Errorf("invalid dedup_window %q", ts.DedupWindow)
+		}
+		ts.dedup, err = parseTemplate(ts.DedupKey)
+		if err != nil {
+			return fmt.Errorf("invalid dedup_key: %s", err)
+		}
+	}
+	return nil
+}
+
+// dedupKey renders the dedup key for an event, it is empty when the notifier
+// does not deduplicate
+func (ts *throttleSettings) dedupKey(e *Event) (string, error) {
+	if ts == nil || ts.dedup == nil {
+		return "", nil
+	}
+	key, err := executeTemplate(ts.dedup, e)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(key)), nil
+}
+
+// throttleState is what we remember about the messages of a single notifier
+type throttleState struct {
+	sent       []time.Time
+	seen       map[string]time.Time
+	suppressed int
+}
+
+// throttler keeps track of the messages sent by every notifier. State is kept
+// in memory, so limits apply per instance and start over when we restart.
+type throttler struct {
+	mu     sync.Mutex
+	states map[int]*throttleState
+}
+
+// throttles is shared by all notify workers
+var throttles = newThrottler()
+
+func newThrottler() *throttler {
+	return &throttler{states: map[int]*throttleState{}}
+}
+
+// admit decides whether notifier id may send a message at now. When it may,
+// the message takes its place in the window and the amount of messages
+// suppressed since the previous one is returned, that count is reset so
+// messages admitted at the same time do not report it again. The caller
+// releases both when the message could not be delivered. Otherwise reason
+// tells why it was suppressed.
+func (t *throttler) admit(id int, ts *throttleSettings, key string, now time.Time) (allowed bool, suppressed int, reason string) {
+	if ts == nil {
+		return true, 0, ""
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states[id]
+	if !ok {
+		state = &throttleState{seen: map[string]time.Time{}}
+		t.states[id] = state
+	}
+
+	for k, at := range state.seen {
+		if now.Sub(at) >= ts.dedupWindow {
+			delete(state.seen, k)
+		}
+	}
+	sent := state.sent[:0]
+	for _, at := range state.sent {
+		if now.Sub(at) < ts.window {
+			sent = append(sent, at)
+		}
+	}
+	state.sent = sent
+
+	if ts.dedup != nil {
+		if at, ok := state.seen[key]; ok {
+			state.suppressed++
+			return false, 0, fmt.Sprintf("duplicate of %q sent at %s", key, at.Format(time.RFC3339))
+		}
+	}
+	if ts.Max > 0 && len(state.sent) >= ts.Max {
+		state.suppressed++
+		return false, 0, fmt.Sprintf("rate limit of %d per %s reached", ts.Max, ts.window)
+	}
+
+	if ts.dedup != nil {
+		state.seen[key] = now
+	}
+	if ts.Max > 0 {
+		state.sent = append(state.sent, now)
+	}
+	suppressed = state.suppressed
+	state.suppressed = 0
+	return true, suppressed, ""
+}
+
+// release gives back the place of a message admitted at now that could not
+// be delivered, so it does not count against the rate limit or dedup key. The
+// suppressed messages it would have mentioned are left for the next one.
+func (t *throttler) release(id int, ts *throttleSettings, key string, now time.Time, suppressed int) {
+	if ts == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.states[id]
+	if !ok {
+		return
+	}
+	state.suppressed += suppressed
+	if ts.dedup != nil && state.seen[key].Equal(now) {
+		delete(state.seen, key)
+	}
+	for i, at := range state.sent {
+		if at.Equal(now) {
+			state.sent = append(state.sent[:i], state.sent[i+1:]...)
+			break
+		}
+	}
+}
+
+// retain drops the state of notifiers that no longer exist
+func (t *throttler) retain(ids map[int]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for id := range t.states {
+		if !ids[id] {
+			delete(t.states, id)
+		}
+	}
+}
+
+// suppressedNote is appended to the first message after others were
+// suppressed
+func suppressedNote(suppressed int) string {
+	if suppressed == 1 {
+		return "\n(1 more suppressed)"
+	}
+	return fmt.Sprintf("\n(%d more suppressed)", suppressed)
+}
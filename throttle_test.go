@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseThrottle(t *testing.T) {
+	for _, raw := range []string{``, `null`, `{}`, `{"max": 0}`} {
+		ts, err := parseThrottle(types.JSONText(raw))
+		assert.Nil(t, err, raw)
+		assert.Nil(t, ts, raw)
+	}
+
+	invalid := []string{
+		`{"max": 10}`,
+		`{"max": -1, "window": "1h"}`,
+		`{"max": 10, "window": "often"}`,
+		`{"dedup_key": "{{ .user_id }}"}`,
+		`{"dedup_key": "{{ .user_id ", "dedup_window": "1h"}`,
+		`{"max": 10, "window": "1h", "burst": 5}`,
+	}
+	for _, raw := range invalid {
+		_, err := parseThrottle(types.JSONText(raw))
+		assert.NotNil(t, err, raw)
+	}
+}
+
+func TestThrottlerRateLimit(t *testing.T) {
+	ts, _ := parseThrottle(types.JSONText(`{"max": 2, "window": "1m"}`))
+	th := newThrottler()
+	now := time.Now()
+
+	allowed, _, _ := th.admit(1, ts, "", now)
+	assert.True(t, allowed)
+	allowed, _, _ = th.admit(1, ts, "", now.Add(time.Second))
+	assert.True(t, allowed)
+	allowed, _, reason := th.admit(1, ts, "", now.Add(2*time.Second))
+	assert.False(t, allowed)
+	assert.Contains(t, reason, "rate limit")
+	allowed, _, _ = th.admit(1, ts, "", now.Add(3*time.Second))
+	assert.False(t, allowed)
+
+	// Other notifiers have their own limit
+	allowed, _, _ = th.admit(2, ts, "", now)
+	assert.True(t, allowed)
+
+	// Once the first message left the window there is room again
+	allowed, suppressed, _ := th.admit(1, ts, "", now.Add(time.Minute))
+	assert.True(t, allowed)
+	assert.Equal(t, 2, suppressed)
+}
+
+func TestThrottlerDedup(t *testing.T) {
+	ts, _ := parseThrottle(types.JSONText(`{"dedup_key": "{{ .user_id }}", "dedup_window": "1h"}`))
+	th := newThrottler()
+	now := time.Now()
+
+	event := Event{Data: types.JSONText(`{"user_id": 12}`)}
+	key, err := ts.dedupKey(&event)
+	assert.Nil(t, err)
+	assert.Equal(t, "12", key)
+
+	allowed, _, _ := th.admit(1, ts, key, now)
+	assert.True(t, allowed)
+	allowed, _, reason := th.admit(1, ts, key, now.Add(time.Minute))
+	assert.False(t, allowed)
+	assert.Contains(t, reason, "duplicate")
+	allowed, suppressed, _ := th.admit(1, ts, "13", now.Add(time.Minute))
+	assert.True(t, allowed)
+	assert.Equal(t, 1, suppressed)
+	allowed, _, _ = th.admit(1, ts, key, now.Add(time.Hour))
+	assert.True(t, allowed)
+}
+
+func TestThrottlerReportsSuppressedOnce(t *testing.T) {
+	strict, _ := parseThrottle(types.JSONText(`{"max": 1, "window": "1h"}`))
+	ts, _ := parseThrottle(types.JSONText(`{"max": 100, "window": "1h"}`))
+	th := newThrottler()
+	now := time.Now()
+	for i := 0; i < 6; i++ {
+		th.admit(1, strict, "", now)
+	}
+	th.states[1].sent = nil
+
+	var reported int64
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			allowed, suppressed, _ := th.admit(1, ts, "", now)
+			assert.True(t, allowed)
+			atomic.AddInt64(&reported, int64(suppressed))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(5), reported)
+
+	// A message that could not be delivered leaves its count for the next one
+	allowed, suppressed, _ := th.admit(1, ts, "", now)
+	assert.True(t, allowed)
+	assert.Equal(t, 0, suppressed)
+	th.release(1, ts, "", now, 3)
+	_, suppressed, _ = th.admit(1, ts, "", now)
+	assert.Equal(t, 3, suppressed)
+}
+
+func TestNotifierAppendsSuppressedNote(t *testing.T) {
+	defer func(th *throttler) { throttles = th }(throttles)
+	throttles = newThrottler()
+
+	n := Notifier{ID: 1, Template: "{{ .name }}", Throttle: types.JSONText(`{"max": 1, "window": "1h"}`)}
+	event := Event{Data: types.JSONText(`{"name": "Go"}`)}
+
+	mn := &LocalMessageNotifier{}
+	d, err := n.evaluate(context.Background(), &event, mn)
+	assert.Nil(t, err)
+	assert.Equal(t, deliveryDelivered, d.Status)
+
+	mn = &LocalMessageNotifier{}
+	d, err = n.evaluate(context.Background(), &event, mn)
+	assert.Nil(t, err)
+	assert.Equal(t, deliverySuppressed, d.Status)
+	assert.False(t, mn.Processed)
+
+	// Make room again by forgetting when the first message was sent
+	throttles.states[1].sent = nil
+	d, err = n.evaluate(context.Background(), &event, mn)
+	assert.Nil(t, err)
+	assert.Equal(t, "Go\n(1 more suppressed)", string(mn.Message))
+}
+
+func TestNotifierFailedDeliveryDoesNotUseThrottle(t *testing.T) {
+	defer func(th *throttler) { throttles = th }(throttles)
+	throttles = newThrottler()
+
+	n := Notifier{ID: 1, Template: "{{ .name }}", Throttle: types.JSONText(`{"max": 1, "window": "1h", "dedup_key": "{{ .name }}", "dedup_window": "1h"}`)}
+	event := Event{Data: types.JSONText(`{"name": "Go"}`)}
+	other := Event{Data: types.JSONText(`{"name": "Rust"}`)}
+
+	d, err := n.evaluate(context.Background(), &event, &LocalMessageNotifier{})
+	assert.Nil(t, err)
+	assert.Equal(t, deliveryDelivered, d.Status)
+
+	// Suppressed by the rate limit and then as a duplicate
+	d, _ = n.evaluate(context.Background(), &other, &LocalMessageNotifier{})
+	assert.Equal(t, deliverySuppressed, d.Status)
+	throttles.states[1].sent = nil
+	d, _ = n.evaluate(context.Background(), &event, &LocalMessageNotifier{})
+	assert.Equal(t, deliverySuppressed, d.Status)
+
+	// A failed delivery neither takes the slot and dedup key nor the note
+	d, err = n.evaluate(context.Background(), &other, &FailingMessageNotifier{})
+	assert.NotNil(t, err)
+	assert.Equal(t, deliveryFailed, d.Status)
+	assert.Empty(t, throttles.states[1].sent)
+	assert.Equal(t, 2, throttles.states[1].suppressed)
+
+	mn := &LocalMessageNotifier{}
+	d, err = n.evaluate(context.Background(), &other, mn)
+	assert.Nil(t, err)
+	assert.Equal(t, deliveryDelivered, d.Status)
+	assert.Equal(t, "Rust\n(2 more suppressed)", string(mn.Message))
+	assert.Equal(t, 0, throttles.states[1].suppressed)
+}